@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/songgao/vpnroutesd/atomicfile"
+)
+
+// cachePath returns where the last known good config for source p is stored
+// under cacheDir. Each source gets its own file so switching --config doesn't
+// fall back to a config from a different source.
+func cachePath(cacheDir string, p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return filepath.Join(cacheDir, "config-"+hex.EncodeToString(sum[:8])+".toml")
+}
+
+func readCache(cacheDir string, p string) (data []byte, savedAt time.Time, err error) {
+	path := cachePath(cacheDir, p)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, fi.ModTime(), nil
+}
+
+// writeCache atomically replaces the cached config for source p with data.
+func writeCache(cacheDir string, p string, data []byte) error {
+	path := cachePath(cacheDir, p)
+	if existing, err := ioutil.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		// Bump mtime so it reflects when the config was last known good.
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+	return atomicfile.WriteFile(path, data)
+}
+
+// signedAtPath returns where the signing time of the last accepted config for
+// source p is stored under cacheDir, next to the cached config.
+func signedAtPath(cacheDir string, p string) string {
+	return strings.TrimSuffix(cachePath(cacheDir, p), ".toml") + ".signed-at"
+}
+
+// readSignedAt returns when the last accepted config for source p was signed,
+// or the zero time if none has been recorded.
+func readSignedAt(cacheDir string, p string) (time.Time, error) {
+	path := signedAtPath(cacheDir, p)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad signing time in %s: %v", path, err)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// writeSignedAt atomically records at as when the last accepted config for
+// source p was signed.
+func writeSignedAt(cacheDir string, p string, at time.Time) error {
+	return atomicfile.WriteFile(signedAtPath(cacheDir, p), []byte(strconv.FormatInt(at.Unix(), 10)+"\n"))
+}
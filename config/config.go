@@ -1,19 +1,104 @@
 package config
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pelletier/go-toml"
+	"github.com/songgao/vpnroutesd/metrics"
 	"go.uber.org/zap"
 )
 
 type configToml struct {
+	Version   int64
+	Include   []string
 	DNSServer string
-	VPNRoutes struct {
-		Domains []string
-		IPs     []string
+	Timeouts  struct {
+		Config string
+		DNS    string
+		Routes string
+	}
+	Health    healthToml
+	VPNRoutes routesToml
+	Groups    map[string]groupToml
+}
+
+type healthToml struct {
+	TCP       []string
+	DNS       []string
+	ICMP      []string
+	Timeout   string
+	OnFailure string
+}
+
+type routesToml struct {
+	Domains []string
+	IPs     []string
+	CIDRs   []string
+
+	RemoveDomains []string
+	RemoveIPs     []string
+	RemoveCIDRs   []string
+
+	MTU        int64
+	AdvMSS     int64
+	Metric     int64
+	Attributes map[string]attributesToml
+}
+
+func (r routesToml) attributes() attributesToml {
+	return attributesToml{MTU: r.MTU, AdvMSS: r.AdvMSS, Metric: r.Metric}
+}
+
+type attributesToml struct {
+	MTU    int64
+	AdvMSS int64
+	Metric int64
+}
+
+// groupToml repeats the fields of routesToml, since go-toml doesn't unmarshal
+// into embedded structs.
+type groupToml struct {
+	Interface        string
+	InterfacePattern string
+	VPNServer        string
+	Health           healthToml
+
+	Domains []string
+	IPs     []string
+	CIDRs   []string
+
+	RemoveDomains []string
+	RemoveIPs     []string
+	RemoveCIDRs   []string
+
+	MTU        int64
+	AdvMSS     int64
+	Metric     int64
+	Attributes map[string]attributesToml
+}
+
+func (g groupToml) routes() routesToml {
+	return routesToml{
+		Domains:       g.Domains,
+		IPs:           g.IPs,
+		CIDRs:         g.CIDRs,
+		RemoveDomains: g.RemoveDomains,
+		RemoveIPs:     g.RemoveIPs,
+		RemoveCIDRs:   g.RemoveCIDRs,
+		MTU:           g.MTU,
+		AdvMSS:        g.AdvMSS,
+		Metric:        g.Metric,
+		Attributes:    g.Attributes,
 	}
 }
 
@@ -22,12 +107,248 @@ type Config struct {
 	DNSServer  net.IP
 	VPNDomains []string
 	VPNIPs     []net.IP
+	VPNCIDRs   []*net.IPNet
+
+	// Attributes are set on routes for VPNDomains, VPNIPs and VPNCIDRs.
+	// EntryAttributes override them for the routes of single entries. See
+	// RouteAttributes.
+	Attributes      RouteAttributes
+	EntryAttributes map[string]RouteAttributes
+
+	// Timeouts holds the stage deadlines set in the config. Zero fields are
+	// not set by any source.
+	Timeouts Timeouts
+
+	// Health configures probes that check the VPN works.
+	Health HealthCheck
+
+	// Groups are destinations routed through interfaces other than the VPN
+	// interface, sorted by name.
+	Groups []RouteGroup
+
+	// Origins maps each entry in VPNDomains, VPNIPs and VPNCIDRs, in its
+	// string form, to the source that added it.
+	Origins map[string]string
+
+	// Sources describes each source the config was merged from, from lowest
+	// to highest precedence.
+	Sources []SourceInfo
+	// Hash identifies the merged config. With a single source, it's the same
+	// as the hash of that source.
+	Hash string
+	// Stale is true if any source couldn't be loaded, and the last known
+	// good copy from the cache is used instead.
+	Stale bool
+	// StaleReason explains why sources are stale.
+	StaleReason error
+}
+
+// Timeouts limits how long each stage of a reconcile iteration can take.
+type Timeouts struct {
+	Config time.Duration
+	DNS    time.Duration
+	Routes time.Duration
+}
+
+// FailurePolicy is what to do with VPN routes when health probes fail.
+type FailurePolicy string
+
+const (
+	// FailureKeep keeps routing VPN destinations through the VPN interface.
+	FailureKeep FailurePolicy = "keep"
+	// FailureWithdraw removes VPN routes, so VPN destinations fall back to
+	// the primary interface.
+	FailureWithdraw FailurePolicy = "withdraw"
+	// FailureReject replaces VPN routes with reject routes, so VPN
+	// destinations are unreachable rather than leak through the primary
+	// interface.
+	FailureReject FailurePolicy = "reject"
+)
+
+// HealthCheck configures probes sent through the VPN interface to check it
+// works. The VPN is healthy if any probe succeeds. No probes means health
+// isn't checked.
+type HealthCheck struct {
+	// TCP lists host:port addresses to connect to.
+	TCP []string
+	// DNS lists DNS servers to query. Any reply counts, even an error.
+	DNS []net.IP
+	// ICMP lists hosts to ping.
+	ICMP []net.IP
+	// Timeout limits each probe. Zero if not set.
+	Timeout time.Duration
+	// OnFailure is empty if not set, which means FailureKeep.
+	OnFailure FailurePolicy
+}
+
+// Empty returns true if there are no probes to send.
+func (hc HealthCheck) Empty() bool {
+	return len(hc.TCP) == 0 && len(hc.DNS) == 0 && len(hc.ICMP) == 0
+}
+
+// WithDefaults returns hc with what it doesn't set taken from defaults.
+// Probes are taken as a whole: if hc has any probe, none from defaults are
+// added to it.
+func (hc HealthCheck) WithDefaults(defaults HealthCheck) HealthCheck {
+	if hc.Empty() {
+		hc.TCP, hc.DNS, hc.ICMP = defaults.TCP, defaults.DNS, defaults.ICMP
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaults.Timeout
+	}
+	if len(hc.OnFailure) == 0 {
+		hc.OnFailure = defaults.OnFailure
+	}
+	return hc
+}
+
+// RouteAttributes are optional attributes of routes. Zero fields are not
+// set.
+//
+// Attributes of an entry are keyed by the entry: a domain in lower case
+// without the trailing dot, or an IP or CIDR in its String form. Attributes
+// of a domain apply to the routes of every IP it resolves to. Those of an IP
+// or CIDR apply to its own route, and take precedence over a domain's.
+type RouteAttributes struct {
+	// MTU is the maximum packet size sent over the route.
+	MTU int
+	// AdvMSS is the TCP maximum segment size advertised to peers over the
+	// route.
+	AdvMSS int
+	// Metric is the route metric, or priority. Lower is preferred.
+	Metric int
+}
+
+// Empty returns true if no attribute is set.
+func (a RouteAttributes) Empty() bool {
+	return a == RouteAttributes{}
+}
+
+// Override returns a with the fields set in b replaced.
+func (a RouteAttributes) Override(b RouteAttributes) RouteAttributes {
+	if b.MTU > 0 {
+		a.MTU = b.MTU
+	}
+	if b.AdvMSS > 0 {
+		a.AdvMSS = b.AdvMSS
+	}
+	if b.Metric > 0 {
+		a.Metric = b.Metric
+	}
+	return a
+}
+
+// DefaultGroup is the name used for VPNDomains, VPNIPs and VPNCIDRs when
+// they're reported along with Groups. No group in Groups can have this name.
+const DefaultGroup = "default"
+
+// RouteGroup is a named set of destinations routed through an interface
+// picked by Interface, InterfacePattern or VPNServer. Exactly one of them is
+// set.
+type RouteGroup struct {
+	Name string
+	// Interface is the exact interface name.
+	Interface string
+	// InterfacePattern matches the interface name. It must match exactly one
+	// interface that has an IPv4 address.
+	InterfacePattern *regexp.Regexp
+	// VPNServer picks the VPN interface whose VPN server address, as
+	// reported by the system, is VPNServer.
+	VPNServer net.IP
+
+	// Health configures probes sent through the group's interface. What the
+	// group doesn't set is taken from Config.Health; see
+	// HealthCheck.WithDefaults.
+	Health HealthCheck
+
+	Domains []string
+	IPs     []net.IP
+	CIDRs   []*net.IPNet
+
+	// Attributes and EntryAttributes are like Config.Attributes and
+	// Config.EntryAttributes, for entries in this group.
+	Attributes      RouteAttributes
+	EntryAttributes map[string]RouteAttributes
+
+	// Origins is like Config.Origins, for entries in this group.
+	Origins map[string]string
 }
 
-var lastConfigData []byte
+// SourceInfo describes a single config source.
+type SourceInfo struct {
+	// Source is the path or URL the source was loaded from.
+	Source string
+	// Hash is the hex encoded SHA-256 of the raw config file.
+	Hash string
+	// SigningKeyID is the ID of the trusted key the source is signed with, or
+	// empty if no trusted keys are set.
+	SigningKeyID string
+	// SignedAt is when the source was signed, from the timestamp in the
+	// trusted comment of its signature, or zero if no trusted keys are set.
+	SignedAt time.Time
+	// Stale is true if Source couldn't be loaded, and the last known good copy
+	// from the cache is used instead. StaleReason is why Source couldn't be
+	// loaded.
+	Stale       bool
+	StaleReason error
+}
 
-// Load reads and parses a vpnroutesd config file from p, which can be one of
-// the following:
+// LoaderOptions configures a Loader.
+type LoaderOptions struct {
+	// CacheDir, if not empty, is where the last known good copy of each source
+	// is kept. See Loader.Load.
+	CacheDir string
+	// HTTPS configures how sources are fetched from https:// URLs.
+	HTTPS HTTPSOptions
+	// TrustedKeys are public keys sources must be signed with. Each key is
+	// either a minisign public key or the path to a minisign .pub file. When
+	// at least one key is set, the Loader fetches a detached signature from
+	// each source path with ".minisig" appended, and rejects the source
+	// unless it's signed by one of the keys. The signature's trusted comment
+	// must have a timestamp, and a source signed before the last one accepted
+	// from the same path is rejected too, so an old config can't be replayed.
+	TrustedKeys []string
+}
+
+// Loader loads configs. It remembers what it has loaded before, to tell
+// whether the config has changed between calls to Load.
+type Loader struct {
+	cacheDir    string
+	https       *httpsFetcher
+	trustedKeys []publicKey
+
+	lock             sync.Mutex
+	lastConfigHash   string
+	lastSourceHashes map[string]string
+	// lastSignedAt is when the last source accepted from each path was
+	// signed. It's read from cacheDir the first time a path is loaded.
+	lastSignedAt map[string]time.Time
+}
+
+// NewLoader creates a Loader.
+func NewLoader(opts LoaderOptions) (*Loader, error) {
+	https, err := newHTTPSFetcher(opts.HTTPS)
+	if err != nil {
+		return nil, fmt.Errorf("bad https options: %v", err)
+	}
+	l := &Loader{
+		cacheDir:         opts.CacheDir,
+		https:            https,
+		lastSourceHashes: make(map[string]string),
+		lastSignedAt:     make(map[string]time.Time),
+	}
+	for _, key := range opts.TrustedKeys {
+		pk, err := loadPublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted key: %v", err)
+		}
+		l.trustedKeys = append(l.trustedKeys, pk)
+	}
+	return l, nil
+}
+
+// Load reads and parses vpnroutesd config files from sources, and merges them
+// into a single Config. Each source can be one of the following:
 //   1. filesystem path, e.g.
 //        /home/user/.vpnroutesd.toml
 //   2. https URL, e.g.
@@ -35,43 +356,445 @@ var lastConfigData []byte
 //   3. keybase filesystem path, e.g.
 //        keybase@alice://team/4seasontotallandscaping/vpn/.vpnroutesd.toml
 //        (alice is the system username, not keybase username)
-func Load(logger *zap.Logger, p string) (cfg Config, changed bool, err error) {
-	data, err := readConfig(logger, p)
+//
+// Sources, and files they Include, are merged as described in merge.go.
+//
+// If the Loader has a CacheDir, every successfully parsed source is saved
+// there, and if a source can't be read or parsed, the last saved copy is used
+// instead, with Stale set to true.
+//
+// If the Loader has TrustedKeys, each source must also come with a valid
+// signature; see LoaderOptions.
+//
+// Fetching sources is canceled when ctx is done, in which case cached copies
+// are used like for any other fetch error.
+func (l *Loader) Load(ctx context.Context, logger *zap.Logger, sources []string) (cfg Config, changed bool, err error) {
+	if len(sources) == 0 {
+		return Config{}, false, errors.New("no config source")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	ll := &layerLoader{
+		ctx:    ctx,
+		logger: logger,
+		loader: l,
+		loaded: make(map[string]*layer),
+	}
+	var layers []*layer
+	for _, source := range sources {
+		if layers, err = ll.expand(layers, source, nil); err != nil {
+			return Config{}, false, err
+		}
+	}
+
+	cfg = merge(logger, layers)
+	changed = cfg.Hash != l.lastConfigHash
+	l.lastConfigHash = cfg.Hash
+	return cfg, changed, nil
+}
+
+// loadLayer fetches, verifies and parses the config file at p.
+func (l *Loader) loadLayer(ctx context.Context, logger *zap.Logger, p string) (*layer, error) {
+	fetchStart := time.Now()
+	data, err := l.readConfig(ctx, logger, p)
+	if err != nil {
+		metrics.ConfigFetchDuration.ObserveSince(fetchStart, sourceType(p), "error")
+		return l.loadLayerFromCache(logger, p, fmt.Errorf("reading config file %s error: %v", p, err))
+	}
+	metrics.ConfigFetchDuration.ObserveSince(fetchStart, sourceType(p), "ok")
+
+	var sig []byte
+	if len(l.trustedKeys) > 0 {
+		if sig, err = l.readConfig(ctx, logger, p+signatureSuffix); err != nil {
+			return l.loadLayerFromCache(logger, p, fmt.Errorf("reading config signature for %s error: %v", p, err))
+		}
+	}
+
+	ly, err := l.parseAndVerify(logger, p, data, sig)
+	if err != nil {
+		return l.loadLayerFromCache(logger, p, err)
+	}
+	if len(l.cacheDir) > 0 {
+		err = writeCache(l.cacheDir, p, data)
+		if err == nil && sig != nil {
+			err = writeCache(l.cacheDir, p+signatureSuffix, sig)
+		}
+		if err != nil {
+			logger.Sugar().Warnf("failed to update config cache: %v", err)
+		}
+	}
+	if len(l.trustedKeys) > 0 {
+		l.recordSignedAt(logger, p, ly.info.SignedAt)
+	}
+
+	l.detectSourceChange(logger, ly.info)
+	return ly, nil
+}
+
+// loadLayerFromCache is called when the config at p couldn't be used due to
+// loadErr. It loads the last known good copy from cacheDir, or returns loadErr
+// if that's not possible.
+func (l *Loader) loadLayerFromCache(logger *zap.Logger, p string, loadErr error) (*layer, error) {
+	if len(l.cacheDir) == 0 {
+		return nil, loadErr
+	}
+	data, savedAt, err := readCache(l.cacheDir, p)
+	if err != nil {
+		logger.Sugar().Debugf("no usable config cache: %v", err)
+		return nil, loadErr
+	}
+	var sig []byte
+	if len(l.trustedKeys) > 0 {
+		if sig, _, err = readCache(l.cacheDir, p+signatureSuffix); err != nil {
+			logger.Sugar().Warnf("ignoring config cache without signature: %v", err)
+			return nil, loadErr
+		}
+	}
+	ly, err := l.parseAndVerify(logger, p, data, sig)
 	if err != nil {
-		return Config{}, false, fmt.Errorf("reading config file error: %v", err)
+		logger.Sugar().Warnf("ignoring bad config cache: %v", err)
+		return nil, loadErr
 	}
-	changed = !bytes.Equal(lastConfigData, data)
-	lastConfigData = data
+	logger.Sugar().Warnf("USING STALE CONFIG cached at %s because loading %s failed: %v",
+		savedAt.Format(time.RFC3339), p, loadErr)
+	ly.info.Stale = true
+	ly.info.StaleReason = loadErr
+	l.detectSourceChange(logger, ly.info)
+	return ly, nil
+}
+
+func (l *Loader) detectSourceChange(logger *zap.Logger, info SourceInfo) {
+	if l.lastSourceHashes[info.Source] == info.Hash {
+		return
+	}
+	l.lastSourceHashes[info.Source] = info.Hash
+	if len(info.SigningKeyID) > 0 {
+		logger.Sugar().Infof("config %s changed to %s; signed by key %s", info.Source, info.Hash, info.SigningKeyID)
+	}
+}
+
+// parseAndVerify verifies sig against the trusted keys if any is set, and then
+// parses data loaded from source.
+func (l *Loader) parseAndVerify(logger *zap.Logger, source string, data []byte, sig []byte) (ly *layer, err error) {
+	var id keyID
+	var at time.Time
+	if len(l.trustedKeys) > 0 {
+		if id, at, err = verifySignature(l.trustedKeys, data, sig); err == nil {
+			err = l.checkSignedAt(source, at)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("verifying config signature for %s error: %v", source, err)
+		}
+	}
+	if ly, err = parse(logger, source, data); err != nil {
+		return nil, err
+	}
+	if len(l.trustedKeys) > 0 {
+		ly.info.SigningKeyID = id.String()
+		ly.info.SignedAt = at
+	}
+	return ly, nil
+}
+
+// checkSignedAt returns an error if at is before when the last source
+// accepted from source was signed.
+func (l *Loader) checkSignedAt(source string, at time.Time) error {
+	last, ok := l.lastSignedAt[source]
+	if !ok && len(l.cacheDir) > 0 {
+		var err error
+		if last, err = readSignedAt(l.cacheDir, source); err != nil {
+			return err
+		}
+		l.lastSignedAt[source] = last
+	}
+	if at.Before(last) {
+		return fmt.Errorf("config signed at %s is older than the one last accepted, signed at %s",
+			at.UTC().Format(time.RFC3339), last.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// recordSignedAt remembers at as when the last source accepted from source
+// was signed, and saves it in cacheDir.
+func (l *Loader) recordSignedAt(logger *zap.Logger, source string, at time.Time) {
+	if !at.After(l.lastSignedAt[source]) {
+		return
+	}
+	l.lastSignedAt[source] = at
+	if len(l.cacheDir) > 0 {
+		if err := writeSignedAt(l.cacheDir, source, at); err != nil {
+			logger.Sugar().Warnf("failed to update config cache: %v", err)
+		}
+	}
+}
+
+// parse parses config data loaded from source. Configs with a Version are
+// rejected on any problem; see CurrentVersion.
+func parse(logger *zap.Logger, source string, data []byte) (ly *layer, err error) {
+	ly, problems, err := parseLayer(source, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		if ly.version > 0 {
+			return nil, problems
+		}
+		for _, problem := range problems {
+			logger.Sugar().Warnf("ignoring problem in unversioned config: %v", problem)
+		}
+	}
+	return ly, nil
+}
+
+// parseLayer parses config data loaded from source. err is for problems that
+// reject the config regardless of its Version. problems are the rest, which
+// have been skipped over in ly.
+func parseLayer(source string, data []byte) (ly *layer, problems ValidationErrors, err error) {
+	sum := sha256.Sum256(data)
+	ly = &layer{
+		info: SourceInfo{
+			Source: source,
+			Hash:   hex.EncodeToString(sum[:]),
+		},
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, nil, ValidationErrors{syntaxError(source, err)}
+	}
+	c := &schemaChecker{
+		source:    source,
+		positions: make(map[string]toml.Position),
+	}
+	c.check(tree, schema, "")
 
 	var cfgToml configToml
-	if err = toml.Unmarshal(data, &cfgToml); err != nil {
-		return Config{}, false, fmt.Errorf("parsing config file error: %v", err)
+	if err = tree.Unmarshal(&cfgToml); err != nil {
+		return nil, nil, append(c.problems, ValidationError{Source: source, Msg: err.Error()})
+	}
+
+	if _, ok := c.positions["Version"]; ok {
+		if cfgToml.Version < 1 || cfgToml.Version > CurrentVersion {
+			pos := c.position("Version")
+			return nil, nil, ValidationErrors{{
+				Source: source,
+				Line:   pos.Line,
+				Col:    pos.Col,
+				Msg:    fmt.Sprintf("unsupported Version %d; this vpnroutesd supports up to %d", cfgToml.Version, CurrentVersion),
+			}}
+		}
+		ly.version = int(cfgToml.Version)
+	}
+
+	if len(cfgToml.DNSServer) > 0 {
+		if ly.dnsServer = net.ParseIP(cfgToml.DNSServer); ly.dnsServer == nil {
+			pos := c.position("DNSServer")
+			return nil, nil, ValidationErrors{{
+				Source: source,
+				Line:   pos.Line,
+				Col:    pos.Col,
+				Msg:    fmt.Sprintf("%s is not a valid IP address", cfgToml.DNSServer),
+			}}
+		}
 	}
 
-	if len(cfgToml.DNSServer) == 0 {
-		logger.Sugar().Debugf("DNSServer missing; using 8.8.8.8")
-		cfg.DNSServer = net.ParseIP("8.8.8.8")
-	} else {
-		cfg.DNSServer = net.ParseIP(cfgToml.DNSServer)
-		if cfg.DNSServer == nil {
-			return Config{}, false, fmt.Errorf("%s is not a valid IP address", cfgToml.DNSServer)
+	for _, include := range cfgToml.Include {
+		if len(strings.TrimSpace(include)) == 0 {
+			c.add(c.position("Include"), "empty include")
+			continue
 		}
+		ly.includes = append(ly.includes, include)
+	}
+
+	ly.timeouts = Timeouts{
+		Config: c.duration("Timeouts.Config", cfgToml.Timeouts.Config),
+		DNS:    c.duration("Timeouts.DNS", cfgToml.Timeouts.DNS),
+		Routes: c.duration("Timeouts.Routes", cfgToml.Timeouts.Routes),
 	}
 
-	cfg.VPNDomains = cfgToml.VPNRoutes.Domains
+	ly.health = c.health("Health.", cfgToml.Health)
+
+	ly.routes = c.routes("vpnroutes.", cfgToml.VPNRoutes)
 
-	for _, ipStr := range cfgToml.VPNRoutes.IPs {
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			logger.Sugar().Warnf("ignoring invalid IP: %s", ipStr)
+	names := make([]string, 0, len(cfgToml.Groups))
+	for name := range cfgToml.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !reGroupName.MatchString(name) {
+			// Already reported by the schema checker.
 			continue
 		}
-		if ip.To4() == nil {
-			logger.Sugar().Warnf("ignoring non-IPv4 IP: %v", ip)
+		if name == DefaultGroup {
+			c.add(c.position("groups."+name), "group name %s is reserved for the vpnroutes table", name)
 			continue
 		}
-		cfg.VPNIPs = append(cfg.VPNIPs, ip)
+		if g := c.group(name, cfgToml.Groups[name]); g != nil {
+			ly.groups = append(ly.groups, g)
+		}
 	}
 
-	return cfg, changed, err
+	return ly, c.problems, nil
+}
+
+func (c *schemaChecker) health(prefix string, h healthToml) HealthCheck {
+	hc := HealthCheck{
+		TCP:     c.hostPorts(prefix+"TCP", h.TCP),
+		DNS:     c.ips(prefix+"DNS", h.DNS),
+		ICMP:    c.ips(prefix+"ICMP", h.ICMP),
+		Timeout: c.duration(prefix+"Timeout", h.Timeout),
+	}
+	if len(h.OnFailure) > 0 {
+		if policy, err := validateFailurePolicy(h.OnFailure); err != nil {
+			c.add(c.position(prefix+"OnFailure"), "%v", err)
+		} else {
+			hc.OnFailure = policy
+		}
+	}
+	return hc
+}
+
+func (c *schemaChecker) routes(prefix string, routes routesToml) layerRoutes {
+	lr := layerRoutes{
+		domains:       c.domains(prefix+"Domains", routes.Domains),
+		removeDomains: c.domains(prefix+"RemoveDomains", routes.RemoveDomains),
+		ips:           c.ips(prefix+"IPs", routes.IPs),
+		removeIPs:     c.ips(prefix+"RemoveIPs", routes.RemoveIPs),
+		cidrs:         c.cidrs(prefix+"CIDRs", routes.CIDRs),
+		removeCIDRs:   c.cidrs(prefix+"RemoveCIDRs", routes.RemoveCIDRs),
+		attrs:         c.attributes(prefix, routes.attributes()),
+	}
+	for entry, a := range routes.Attributes {
+		key, err := validateEntry(entry)
+		if err != nil {
+			// Already reported by the schema checker.
+			continue
+		}
+		if lr.entryAttrs == nil {
+			lr.entryAttrs = make(map[string]RouteAttributes)
+		}
+		lr.entryAttrs[key] = c.attributes(prefix+"Attributes."+entry+".", a)
+	}
+	return lr
+}
+
+func (c *schemaChecker) attributes(prefix string, a attributesToml) (attrs RouteAttributes) {
+	for _, f := range []struct {
+		name  string
+		value int64
+		min   int64
+		max   int64
+		field *int
+	}{
+		{"MTU", a.MTU, minMTU, maxMTU, &attrs.MTU},
+		{"AdvMSS", a.AdvMSS, 1, maxMTU - 40, &attrs.AdvMSS},
+		{"Metric", a.Metric, 1, 1<<32 - 1, &attrs.Metric},
+	} {
+		if f.value == 0 {
+			continue
+		}
+		if f.value < f.min || f.value > f.max {
+			c.add(c.position(prefix+f.name), "%s%s should be between %d and %d", prefix, f.name, f.min, f.max)
+			continue
+		}
+		*f.field = int(f.value)
+	}
+	return attrs
+}
+
+func (c *schemaChecker) group(name string, g groupToml) *layerGroup {
+	prefix := "groups." + name + "."
+	ly := &layerGroup{
+		name:   name,
+		routes: c.routes(prefix, g.routes()),
+		health: c.health(prefix+"Health.", g.Health),
+	}
+	bindings := 0
+	if len(g.Interface) > 0 {
+		ly.iface = g.Interface
+		bindings++
+	}
+	if len(g.InterfacePattern) > 0 {
+		pattern, err := regexp.Compile(g.InterfacePattern)
+		if err != nil {
+			c.add(c.position(prefix+"InterfacePattern"), "invalid InterfacePattern: %v", err)
+			return nil
+		}
+		ly.interfacePattern = pattern
+		bindings++
+	}
+	if len(g.VPNServer) > 0 {
+		ip, err := validateIP(g.VPNServer)
+		if err != nil {
+			c.add(c.position(prefix+"VPNServer"), "%v", err)
+			return nil
+		}
+		ly.vpnServer = ip
+		bindings++
+	}
+	if bindings > 1 {
+		c.add(c.position("groups."+name), "group %s can only set one of Interface, InterfacePattern and VPNServer", name)
+		return nil
+	}
+	return ly
+}
+
+func (c *schemaChecker) duration(path string, durationStr string) time.Duration {
+	if len(durationStr) == 0 {
+		return 0
+	}
+	d, err := validateDuration(durationStr)
+	if err != nil {
+		c.add(c.position(path), "%v", err)
+		return 0
+	}
+	return d
+}
+
+func (c *schemaChecker) domains(path string, domainStrs []string) (domains []string) {
+	for _, domain := range domainStrs {
+		if err := ValidateDomain(domain); err != nil {
+			c.add(c.position(path), "%v", err)
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+func (c *schemaChecker) hostPorts(path string, hostPortStrs []string) (hostPorts []string) {
+	for _, hostPort := range hostPortStrs {
+		if err := validateHostPort(hostPort); err != nil {
+			c.add(c.position(path), "%v", err)
+			continue
+		}
+		hostPorts = append(hostPorts, hostPort)
+	}
+	return hostPorts
+}
+
+func (c *schemaChecker) ips(path string, ipStrs []string) (ips []net.IP) {
+	for _, ipStr := range ipStrs {
+		ip, err := validateIP(ipStr)
+		if err != nil {
+			c.add(c.position(path), "%v", err)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func (c *schemaChecker) cidrs(path string, cidrStrs []string) (cidrs []*net.IPNet) {
+	for _, cidrStr := range cidrStrs {
+		cidr, err := validateCIDR(cidrStr)
+		if err != nil {
+			c.add(c.position(path), "%v", err)
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs
 }
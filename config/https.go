@@ -0,0 +1,207 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HTTPSOptions configures how config files are fetched from https:// URLs.
+type HTTPSOptions struct {
+	// ConnectTimeout limits how long establishing the connection, including
+	// the TLS handshake, can take. Defaults to 10s.
+	ConnectTimeout time.Duration
+	// ReadTimeout limits how long it can take to receive the full response
+	// once connected. Defaults to 30s.
+	ReadTimeout time.Duration
+	// MaxBodySize is the maximum size of the config file in bytes. Defaults to
+	// 1 MiB.
+	MaxBodySize int64
+
+	// BearerTokenFile is a file containing a token to send as
+	// "Authorization: Bearer <token>".
+	BearerTokenFile string
+	// BasicAuthFile is a file containing "<username>:<password>" to send as
+	// HTTP basic auth. Only one of BearerTokenFile and BasicAuthFile can be
+	// set.
+	BasicAuthFile string
+
+	// CAFile is a PEM bundle of CA certificates to verify the server against,
+	// instead of the system roots.
+	CAFile string
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key to
+	// present to the server for mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+const (
+	defaultHTTPSConnectTimeout = 10 * time.Second
+	defaultHTTPSReadTimeout    = 30 * time.Second
+	defaultHTTPSMaxBodySize    = 1 << 20
+)
+
+// httpsCacheEntry holds the validators from the last successful response for
+// a URL, and the body that came with it, so a 304 can be answered locally.
+type httpsCacheEntry struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+type httpsFetcher struct {
+	opts   HTTPSOptions
+	client *http.Client
+
+	lock  sync.Mutex
+	cache map[string]httpsCacheEntry
+}
+
+func newHTTPSFetcher(opts HTTPSOptions) (*httpsFetcher, error) {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = defaultHTTPSConnectTimeout
+	}
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = defaultHTTPSReadTimeout
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = defaultHTTPSMaxBodySize
+	}
+	if len(opts.BearerTokenFile) > 0 && len(opts.BasicAuthFile) > 0 {
+		return nil, errors.New("only one of bearer token and basic auth can be used")
+	}
+	if (len(opts.ClientCertFile) == 0) != (len(opts.ClientKeyFile) == 0) {
+		return nil, errors.New("client certificate and key must be supplied together")
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(opts.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+	if len(opts.ClientCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: opts.ConnectTimeout,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.ReadTimeout,
+	}
+	return &httpsFetcher{
+		opts: opts,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.ConnectTimeout + opts.ReadTimeout,
+		},
+		cache: make(map[string]httpsCacheEntry),
+	}, nil
+}
+
+func (f *httpsFetcher) setAuth(req *http.Request) error {
+	if len(f.opts.BearerTokenFile) > 0 {
+		token, err := ioutil.ReadFile(f.opts.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if len(f.opts.BasicAuthFile) > 0 {
+		data, err := ioutil.ReadFile(f.opts.BasicAuthFile)
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s should be in the format of <username>:<password>", f.opts.BasicAuthFile)
+		}
+		req.SetBasicAuth(parts[0], parts[1])
+	}
+	return nil
+}
+
+// get fetches url. If the server says the file hasn't been modified since the
+// last successful fetch, the previous body is returned.
+func (f *httpsFetcher) get(ctx context.Context, logger *zap.Logger, url string) (data []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.setAuth(req); err != nil {
+		return nil, fmt.Errorf("loading credentials error: %v", err)
+	}
+
+	f.lock.Lock()
+	cached, hasCached := f.cache[url]
+	f.lock.Unlock()
+	if hasCached {
+		if len(cached.etag) > 0 {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if len(cached.lastModified) > 0 {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && hasCached:
+		logger.Sugar().Debugf("config at %s not modified", url)
+		return cached.body, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, f.opts.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > f.opts.MaxBodySize {
+		return nil, fmt.Errorf("config file is larger than %d bytes", f.opts.MaxBodySize)
+	}
+
+	entry := httpsCacheEntry{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         data,
+	}
+	f.lock.Lock()
+	if len(entry.etag) > 0 || len(entry.lastModified) > 0 {
+		f.cache[url] = entry
+	} else {
+		delete(f.cache, url)
+	}
+	f.lock.Unlock()
+
+	return data, nil
+}
@@ -1,9 +1,9 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os/exec"
 	"os/user"
 	"regexp"
@@ -16,7 +16,21 @@ import (
 
 var reKeybase = regexp.MustCompile(`keybase@([a-z][a-z0-9]*):\/\/((?:team|private|public).*)`)
 
-func readConfig(logger *zap.Logger, p string) (data []byte, err error) {
+// sourceType returns "keybase", "https" or "file" depending on what kind of
+// config source p is.
+func sourceType(p string) string {
+	p = strings.TrimSpace(p)
+	switch {
+	case strings.HasPrefix(p, "keybase"):
+		return "keybase"
+	case strings.HasPrefix(p, "https://"):
+		return "https"
+	default:
+		return "file"
+	}
+}
+
+func (l *Loader) readConfig(ctx context.Context, logger *zap.Logger, p string) (data []byte, err error) {
 	p = strings.TrimSpace(p)
 	if strings.HasPrefix(p, "keybase") {
 		matches := reKeybase.FindStringSubmatch(p)
@@ -41,7 +55,7 @@ func readConfig(logger *zap.Logger, p string) (data []byte, err error) {
 			return nil, err
 		}
 
-		cmd := exec.Command("keybase", "fs", "read", kbfsPath)
+		cmd := exec.CommandContext(ctx, "keybase", "fs", "read", kbfsPath)
 		cmd.SysProcAttr = &syscall.SysProcAttr{
 			Credential: &syscall.Credential{
 				Uid:         uint32(uid),
@@ -52,12 +66,7 @@ func readConfig(logger *zap.Logger, p string) (data []byte, err error) {
 		return cmd.Output()
 	} else if strings.HasPrefix(p, "https://") {
 		logger.Sugar().Debugf("reading config at URL %s", p)
-		resp, err := http.Get(p)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-		return ioutil.ReadAll(resp.Body)
+		return l.https.get(ctx, logger, p)
 	} else {
 		logger.Sugar().Debugf("reading config at filesystem path %s", p)
 		return ioutil.ReadFile(p)
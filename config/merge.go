@@ -0,0 +1,415 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// A config can be made of multiple sources, e.g. a team-wide policy fetched
+// over HTTPS plus a personal overrides file on the local filesystem. Sources
+// are layered, and a source has higher precedence than any source before it:
+//
+//   1. Sources passed to Loader.Load are layered in the order they are passed in.
+//   2. Files listed in a source's Include are layered right before the source
+//      itself, in the order they are listed. So a file always takes
+//      precedence over what it includes. Relative includes are resolved
+//      against the including source. Remote sources can't include local
+//      files, nor sources elsewhere; see resolveInclude.
+//   3. A source that appears more than once is only layered at its first
+//      appearance.
+//
+// Layers are then merged from lowest to highest precedence:
+//
+//   - DNSServer, and each of Timeouts and Health, from the highest layer
+//     that sets it wins.
+//   - Entries in RemoveDomains, RemoveIPs and RemoveCIDRs of a layer remove
+//     matching entries added by lower layers.
+//   - Entries in Domains, IPs and CIDRs of a layer are added, and remember
+//     the layer as their origin.
+//   - Each of MTU, AdvMSS and Metric, of a table or of an entry under its
+//     Attributes, from the highest layer that sets it wins.
+//   - Groups with the same name are merged the same way, and so is their
+//     Health. Interface, InterfacePattern and VPNServer are set together by
+//     the highest layer that sets any of them. A group none of them is set
+//     for is dropped. Whatever a group's Health doesn't set comes from the
+//     merged Health.
+
+const maxIncludeDepth = 8
+
+// layer is a parsed config source.
+type layer struct {
+	info    SourceInfo
+	version int // 0 if the config doesn't have a Version
+
+	includes  []string
+	dnsServer net.IP
+	timeouts  Timeouts
+	health    HealthCheck
+
+	routes layerRoutes
+	groups []*layerGroup
+}
+
+// layerRoutes are the entries a layer adds and removes, either for the VPN
+// interface or for a group.
+type layerRoutes struct {
+	domains []string
+	ips     []net.IP
+	cidrs   []*net.IPNet
+
+	removeDomains []string
+	removeIPs     []net.IP
+	removeCIDRs   []*net.IPNet
+
+	attrs      RouteAttributes
+	entryAttrs map[string]RouteAttributes
+}
+
+// layerGroup is a route group as set by a single layer. At most one of iface,
+// interfacePattern and vpnServer is set.
+type layerGroup struct {
+	name             string
+	iface            string
+	interfacePattern *regexp.Regexp
+	vpnServer        net.IP
+	routes           layerRoutes
+	health           HealthCheck
+}
+
+func (g *layerGroup) hasBinding() bool {
+	return len(g.iface) > 0 || g.interfacePattern != nil || g.vpnServer != nil
+}
+
+// layerLoader loads layers for a single Loader.Load call.
+type layerLoader struct {
+	ctx    context.Context
+	logger *zap.Logger
+	loader *Loader
+	loaded map[string]*layer
+}
+
+// expand loads source and everything it includes, and appends them to layers
+// in precedence order. stack holds the sources that include source, to detect
+// include cycles.
+func (l *layerLoader) expand(layers []*layer, source string, stack []string) ([]*layer, error) {
+	for _, s := range stack {
+		if s == source {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), source)
+		}
+	}
+	if len(stack) >= maxIncludeDepth {
+		return nil, fmt.Errorf("includes are nested deeper than %d: %s", maxIncludeDepth, strings.Join(stack, " -> "))
+	}
+	if _, ok := l.loaded[source]; ok {
+		return layers, nil
+	}
+
+	ly, err := l.loader.loadLayer(l.ctx, l.logger, source)
+	if err != nil {
+		return nil, err
+	}
+	l.loaded[source] = ly
+
+	stack = append(stack, source)
+	for _, include := range ly.includes {
+		resolved, err := resolveInclude(source, include)
+		if err != nil {
+			return nil, err
+		}
+		if layers, err = l.expand(layers, resolved, stack); err != nil {
+			return nil, err
+		}
+	}
+	return append(layers, ly), nil
+}
+
+// resolveInclude resolves include against base, the source that includes it.
+//
+// Remote sources are held to what they can reach themselves: an HTTPS config
+// can only include configs on its own host, and a KBFS config only relative
+// paths or KBFS configs read as the same user. Otherwise a remote config could
+// make vpnroutesd, which runs as root, read local files, fetch any URL, or
+// run keybase as any local user.
+func resolveInclude(base string, include string) (string, error) {
+	include = strings.TrimSpace(include)
+	switch sourceType(base) {
+	case "https":
+		if sourceType(include) == "keybase" {
+			return "", fmt.Errorf("bad include %q in %s: HTTPS configs can't include KBFS configs", include, base)
+		}
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(include)
+		if err != nil {
+			return "", fmt.Errorf("bad include %q in %s: %v", include, base, err)
+		}
+		resolved := baseURL.ResolveReference(ref)
+		if resolved.Scheme != baseURL.Scheme || resolved.Host != baseURL.Host {
+			return "", fmt.Errorf("bad include %q in %s: HTTPS configs can only include configs on the same host", include, base)
+		}
+		return resolved.String(), nil
+	case "keybase":
+		switch sourceType(include) {
+		case "keybase":
+			baseMatches, matches := reKeybase.FindStringSubmatch(base), reKeybase.FindStringSubmatch(include)
+			if len(baseMatches) == 0 || len(matches) == 0 || matches[1] != baseMatches[1] {
+				return "", fmt.Errorf("bad include %q in %s: KBFS configs can only include KBFS configs of the same user", include, base)
+			}
+			return include, nil
+		case "https":
+			return "", fmt.Errorf("bad include %q in %s: KBFS configs can't include HTTPS configs", include, base)
+		}
+		if strings.HasPrefix(include, "/") {
+			return "", fmt.Errorf("bad include %q in %s: KBFS configs can't include local files", include, base)
+		}
+		i := strings.Index(base, "://")
+		return base[:i+3] + path.Join(path.Dir(base[i+3:]), include), nil
+	default:
+		if sourceType(include) != "file" || filepath.IsAbs(include) {
+			return include, nil
+		}
+		return filepath.Join(filepath.Dir(base), include), nil
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+type mergeEntry struct {
+	value  interface{}
+	origin string
+}
+
+// entrySet is a set of config entries that remembers insertion order.
+type entrySet struct {
+	kind    string
+	order   []string
+	entries map[string]mergeEntry
+}
+
+func newEntrySet(kind string) *entrySet {
+	return &entrySet{kind: kind, entries: make(map[string]mergeEntry)}
+}
+
+func (s *entrySet) add(key string, value interface{}, origin string) {
+	if _, ok := s.entries[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.entries[key] = mergeEntry{value: value, origin: origin}
+}
+
+func (s *entrySet) remove(logger *zap.Logger, key string, by string) {
+	existing, ok := s.entries[key]
+	if !ok {
+		logger.Sugar().Debugf("%s removes %s %s, which no lower layer adds", by, s.kind, key)
+		return
+	}
+	logger.Sugar().Debugf("%s removes %s %s added by %s", by, s.kind, key, existing.origin)
+	delete(s.entries, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// each calls f on remaining entries in insertion order. An entry removed and
+// added again counts as inserted when it's added again.
+func (s *entrySet) each(f func(key string, entry mergeEntry)) {
+	for _, key := range s.order {
+		f(key, s.entries[key])
+	}
+}
+
+// routeSets are the merged entries for the VPN interface or a group, along
+// with their route attributes.
+type routeSets struct {
+	domains *entrySet
+	ips     *entrySet
+	cidrs   *entrySet
+
+	attrs      RouteAttributes
+	entryAttrs map[string]RouteAttributes
+}
+
+func newRouteSets() *routeSets {
+	return &routeSets{
+		domains:    newEntrySet("domain"),
+		ips:        newEntrySet("IP"),
+		cidrs:      newEntrySet("CIDR"),
+		entryAttrs: make(map[string]RouteAttributes),
+	}
+}
+
+// merge applies removals and then additions from a single layer.
+func (s *routeSets) merge(logger *zap.Logger, lr layerRoutes, source string) {
+	for _, domain := range lr.removeDomains {
+		s.domains.remove(logger, normalizeDomain(domain), source)
+	}
+	for _, ip := range lr.removeIPs {
+		s.ips.remove(logger, ip.String(), source)
+	}
+	for _, cidr := range lr.removeCIDRs {
+		s.cidrs.remove(logger, cidr.String(), source)
+	}
+
+	for _, domain := range lr.domains {
+		s.domains.add(normalizeDomain(domain), domain, source)
+	}
+	for _, ip := range lr.ips {
+		s.ips.add(ip.String(), ip, source)
+	}
+	for _, cidr := range lr.cidrs {
+		s.cidrs.add(cidr.String(), cidr, source)
+	}
+
+	s.attrs = s.attrs.Override(lr.attrs)
+	for key, attrs := range lr.entryAttrs {
+		s.entryAttrs[key] = s.entryAttrs[key].Override(attrs)
+	}
+}
+
+// result returns the remaining entries, and maps each of them in its string
+// form to where it came from.
+func (s *routeSets) result() (domains []string, ips []net.IP, cidrs []*net.IPNet, origins map[string]string) {
+	origins = make(map[string]string)
+	s.domains.each(func(key string, entry mergeEntry) {
+		domains = append(domains, entry.value.(string))
+		origins[entry.value.(string)] = entry.origin
+	})
+	s.ips.each(func(key string, entry mergeEntry) {
+		ips = append(ips, entry.value.(net.IP))
+		origins[key] = entry.origin
+	})
+	s.cidrs.each(func(key string, entry mergeEntry) {
+		cidrs = append(cidrs, entry.value.(*net.IPNet))
+		origins[key] = entry.origin
+	})
+	return domains, ips, cidrs, origins
+}
+
+// mergeHealth sets each field of hc that lh sets.
+func mergeHealth(hc *HealthCheck, lh HealthCheck) {
+	if len(lh.TCP) > 0 {
+		hc.TCP = lh.TCP
+	}
+	if len(lh.DNS) > 0 {
+		hc.DNS = lh.DNS
+	}
+	if len(lh.ICMP) > 0 {
+		hc.ICMP = lh.ICMP
+	}
+	if lh.Timeout > 0 {
+		hc.Timeout = lh.Timeout
+	}
+	if len(lh.OnFailure) > 0 {
+		hc.OnFailure = lh.OnFailure
+	}
+}
+
+// merge merges layers, from lowest to highest precedence, into a Config.
+func merge(logger *zap.Logger, layers []*layer) (cfg Config) {
+	routes := newRouteSets()
+	groupRoutes := make(map[string]*routeSets)
+	groupBindings := make(map[string]*layerGroup)
+	groupHealth := make(map[string]HealthCheck)
+
+	var staleReasons []string
+	for _, ly := range layers {
+		source := ly.info.Source
+		cfg.Sources = append(cfg.Sources, ly.info)
+		if ly.info.Stale {
+			cfg.Stale = true
+			staleReasons = append(staleReasons, ly.info.StaleReason.Error())
+		}
+		if ly.dnsServer != nil {
+			cfg.DNSServer = ly.dnsServer
+		}
+		if ly.timeouts.Config > 0 {
+			cfg.Timeouts.Config = ly.timeouts.Config
+		}
+		if ly.timeouts.DNS > 0 {
+			cfg.Timeouts.DNS = ly.timeouts.DNS
+		}
+		if ly.timeouts.Routes > 0 {
+			cfg.Timeouts.Routes = ly.timeouts.Routes
+		}
+		mergeHealth(&cfg.Health, ly.health)
+
+		routes.merge(logger, ly.routes, source)
+		for _, g := range ly.groups {
+			if groupRoutes[g.name] == nil {
+				groupRoutes[g.name] = newRouteSets()
+			}
+			groupRoutes[g.name].merge(logger, g.routes, source)
+			health := groupHealth[g.name]
+			mergeHealth(&health, g.health)
+			groupHealth[g.name] = health
+			if g.hasBinding() {
+				groupBindings[g.name] = g
+			}
+		}
+	}
+
+	if cfg.DNSServer == nil {
+		logger.Sugar().Debugf("DNSServer missing; using 8.8.8.8")
+		cfg.DNSServer = net.ParseIP("8.8.8.8")
+	}
+
+	cfg.VPNDomains, cfg.VPNIPs, cfg.VPNCIDRs, cfg.Origins = routes.result()
+	cfg.Attributes, cfg.EntryAttributes = routes.attrs, routes.entryAttrs
+
+	names := make([]string, 0, len(groupRoutes))
+	for name := range groupRoutes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		binding := groupBindings[name]
+		if binding == nil {
+			logger.Sugar().Warnf("group %s doesn't set Interface, InterfacePattern or VPNServer; ignoring it", name)
+			continue
+		}
+		g := RouteGroup{
+			Name:             name,
+			Interface:        binding.iface,
+			InterfacePattern: binding.interfacePattern,
+			VPNServer:        binding.vpnServer,
+			Health:           groupHealth[name].WithDefaults(cfg.Health),
+		}
+		g.Domains, g.IPs, g.CIDRs, g.Origins = groupRoutes[name].result()
+		g.Attributes, g.EntryAttributes = groupRoutes[name].attrs, groupRoutes[name].entryAttrs
+		cfg.Groups = append(cfg.Groups, g)
+	}
+
+	if len(staleReasons) > 0 {
+		cfg.StaleReason = fmt.Errorf("%s", strings.Join(staleReasons, "; "))
+	}
+
+	if len(layers) == 1 {
+		cfg.Hash = layers[0].info.Hash
+	} else {
+		h := sha256.New()
+		for _, ly := range layers {
+			fmt.Fprintf(h, "%s\x00%s\n", ly.info.Source, ly.info.Hash)
+		}
+		cfg.Hash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return cfg
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMergePrecedence(t *testing.T) {
+	tests := []struct {
+		name      string
+		layers    []string
+		domains   []string
+		ips       []string
+		cidrs     []string
+		origins   map[string]string
+		mtu       int
+		entryMTUs map[string]int
+		dnsServer string
+	}{
+		{
+			name: "later layers add after earlier ones",
+			layers: []string{
+				`[vpnroutes]
+				Domains = ["a.example.com"]
+				IPs = ["10.0.0.1"]`,
+				`[vpnroutes]
+				Domains = ["b.example.com"]
+				IPs = ["10.0.0.2"]`,
+			},
+			domains: []string{"a.example.com", "b.example.com"},
+			ips:     []string{"10.0.0.1", "10.0.0.2"},
+			origins: map[string]string{
+				"a.example.com": "layer0",
+				"b.example.com": "layer1",
+				"10.0.0.1":      "layer0",
+				"10.0.0.2":      "layer1",
+			},
+		},
+		{
+			name: "remove drops entries of lower layers",
+			layers: []string{
+				`[vpnroutes]
+				Domains = ["a.example.com", "b.example.com"]
+				CIDRs = ["10.1.0.0/16", "10.2.0.0/16"]`,
+				`[vpnroutes]
+				RemoveDomains = ["A.example.com."]
+				RemoveCIDRs = ["10.2.0.0/16"]`,
+			},
+			domains: []string{"b.example.com"},
+			cidrs:   []string{"10.1.0.0/16"},
+			origins: map[string]string{
+				"b.example.com": "layer0",
+				"10.1.0.0/16":   "layer0",
+			},
+		},
+		{
+			name: "remove then re-add yields the entry once, from the re-adding layer",
+			layers: []string{
+				`[vpnroutes]
+				Domains = ["a.example.com", "b.example.com"]
+				IPs = ["10.0.0.1", "10.0.0.2"]`,
+				`[vpnroutes]
+				RemoveDomains = ["a.example.com"]
+				RemoveIPs = ["10.0.0.1"]`,
+				`[vpnroutes]
+				Domains = ["a.example.com"]
+				IPs = ["10.0.0.1"]`,
+			},
+			domains: []string{"b.example.com", "a.example.com"},
+			ips:     []string{"10.0.0.2", "10.0.0.1"},
+			origins: map[string]string{
+				"a.example.com": "layer2",
+				"b.example.com": "layer0",
+				"10.0.0.1":      "layer2",
+				"10.0.0.2":      "layer0",
+			},
+		},
+		{
+			name: "remove and re-add in the same layer keeps the entry",
+			layers: []string{
+				`[vpnroutes]
+				IPs = ["10.0.0.1"]`,
+				`[vpnroutes]
+				RemoveIPs = ["10.0.0.1"]
+				IPs = ["10.0.0.1"]`,
+			},
+			ips: []string{"10.0.0.1"},
+			origins: map[string]string{
+				"10.0.0.1": "layer1",
+			},
+		},
+		{
+			name: "highest layer setting a value wins",
+			layers: []string{
+				`DNSServer = "10.0.0.53"
+				[vpnroutes]
+				MTU = 1400
+				IPs = ["10.0.0.1"]
+				[vpnroutes.Attributes."10.0.0.1"]
+				MTU = 1300`,
+				`[vpnroutes]
+				MTU = 1380`,
+				`DNSServer = "10.0.1.53"`,
+			},
+			ips:       []string{"10.0.0.1"},
+			origins:   map[string]string{"10.0.0.1": "layer0"},
+			mtu:       1380,
+			entryMTUs: map[string]int{"10.0.0.1": 1300},
+			dnsServer: "10.0.1.53",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var layers []*layer
+			for i, data := range test.layers {
+				ly, problems, err := parseLayer(fmt.Sprintf("layer%d", i), []byte(data))
+				if err != nil || len(problems) > 0 {
+					t.Fatalf("parsing layer%d: %v %v", i, err, problems)
+				}
+				layers = append(layers, ly)
+			}
+			cfg := merge(zap.NewNop(), layers)
+
+			var ips, cidrs []string
+			for _, ip := range cfg.VPNIPs {
+				ips = append(ips, ip.String())
+			}
+			for _, cidr := range cfg.VPNCIDRs {
+				cidrs = append(cidrs, cidr.String())
+			}
+			if !reflect.DeepEqual(cfg.VPNDomains, test.domains) {
+				t.Errorf("domains: got %v, want %v", cfg.VPNDomains, test.domains)
+			}
+			if !reflect.DeepEqual(ips, test.ips) {
+				t.Errorf("IPs: got %v, want %v", ips, test.ips)
+			}
+			if !reflect.DeepEqual(cidrs, test.cidrs) {
+				t.Errorf("CIDRs: got %v, want %v", cidrs, test.cidrs)
+			}
+			if !reflect.DeepEqual(cfg.Origins, test.origins) {
+				t.Errorf("origins: got %v, want %v", cfg.Origins, test.origins)
+			}
+			if cfg.Attributes.MTU != test.mtu {
+				t.Errorf("MTU: got %d, want %d", cfg.Attributes.MTU, test.mtu)
+			}
+			for entry, mtu := range test.entryMTUs {
+				if got := cfg.EntryAttributes[entry].MTU; got != mtu {
+					t.Errorf("MTU of %s: got %d, want %d", entry, got, mtu)
+				}
+			}
+			dnsServer := net.ParseIP("8.8.8.8")
+			if len(test.dnsServer) > 0 {
+				dnsServer = net.ParseIP(test.dnsServer)
+			}
+			if !cfg.DNSServer.Equal(dnsServer) {
+				t.Errorf("DNSServer: got %s, want %s", cfg.DNSServer, dnsServer)
+			}
+		})
+	}
+}
+
+func TestResolveInclude(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		include string
+		want    string
+		problem string
+	}{
+		{
+			name:    "relative to a file",
+			base:    "/etc/vpnroutesd/vpnroutesd.toml",
+			include: "team.toml",
+			want:    "/etc/vpnroutesd/team.toml",
+		},
+		{
+			name:    "remote from a file",
+			base:    "/etc/vpnroutesd/vpnroutesd.toml",
+			include: "keybase@alice://team/acme/vpn.toml",
+			want:    "keybase@alice://team/acme/vpn.toml",
+		},
+		{
+			name:    "relative to a URL",
+			base:    "https://example.com/vpn/base.toml",
+			include: "../team.toml",
+			want:    "https://example.com/team.toml",
+		},
+		{
+			name:    "URL on the same host",
+			base:    "https://example.com/vpn/base.toml",
+			include: "https://example.com/team.toml",
+			want:    "https://example.com/team.toml",
+		},
+		{
+			name:    "URL on another host",
+			base:    "https://example.com/vpn/base.toml",
+			include: "https://example.net/team.toml",
+			problem: "same host",
+		},
+		{
+			name:    "network-path reference to another host",
+			base:    "https://example.com/vpn/base.toml",
+			include: "//example.net/team.toml",
+			problem: "same host",
+		},
+		{
+			name:    "KBFS from a URL",
+			base:    "https://example.com/vpn/base.toml",
+			include: "keybase@root://private/root/vpn.toml",
+			problem: "can't include KBFS",
+		},
+		{
+			name:    "relative to KBFS",
+			base:    "keybase@alice://team/acme/vpn/base.toml",
+			include: "team.toml",
+			want:    "keybase@alice://team/acme/vpn/team.toml",
+		},
+		{
+			name:    "KBFS of the same user",
+			base:    "keybase@alice://team/acme/vpn/base.toml",
+			include: "keybase@alice://private/alice/vpn.toml",
+			want:    "keybase@alice://private/alice/vpn.toml",
+		},
+		{
+			name:    "KBFS of another user",
+			base:    "keybase@alice://team/acme/vpn/base.toml",
+			include: "keybase@root://private/root/vpn.toml",
+			problem: "same user",
+		},
+		{
+			name:    "URL from KBFS",
+			base:    "keybase@alice://team/acme/vpn/base.toml",
+			include: "https://example.com/team.toml",
+			problem: "can't include HTTPS",
+		},
+		{
+			name:    "local file from KBFS",
+			base:    "keybase@alice://team/acme/vpn/base.toml",
+			include: "/etc/passwd",
+			problem: "local files",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveInclude(test.base, test.include)
+			if len(test.problem) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.problem) {
+					t.Errorf("got %q, %v; want an error about %q", got, err, test.problem)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Signatures are in minisign format (https://jedisct1.github.io/minisign/).
+// A public key is base64 of:
+//   "Ed" || key ID (8 bytes) || ed25519 public key (32 bytes)
+// A signature file is:
+//   untrusted comment: <anything>
+//   base64("Ed" or "ED" || key ID (8 bytes) || ed25519 signature (64 bytes))
+//   trusted comment: <text>
+//   base64(ed25519 signature of (signature || text))
+// where "ED" means the signature is over the BLAKE2b-512 hash of the file
+// rather than the file itself.
+//
+// minisign's default trusted comment, e.g.
+//   timestamp:1606780800	file:.vpnroutesd.toml
+// carries when the file was signed. Since it's signed too, it tells a replayed
+// older config apart from the current one; see Loader.checkSignedAt.
+
+const signatureSuffix = ".minisig"
+
+var (
+	sigAlgEd        = [2]byte{'E', 'd'}
+	sigAlgPrehashed = [2]byte{'E', 'D'}
+)
+
+type keyID [8]byte
+
+// String formats the key ID the same way minisign does.
+func (id keyID) String() string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+type publicKey struct {
+	id  keyID
+	key ed25519.PublicKey
+}
+
+// parsePublicKey parses a minisign public key, either as the bare base64 line
+// or as the content of a .pub file including the untrusted comment line.
+func parsePublicKey(s string) (pk publicKey, err error) {
+	var encoded string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		encoded = line
+		break
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return publicKey{}, fmt.Errorf("bad public key: %v", err)
+	}
+	if len(b) != 2+8+ed25519.PublicKeySize || !bytes.Equal(b[:2], sigAlgEd[:]) {
+		return publicKey{}, errors.New("bad public key: not a minisign ed25519 public key")
+	}
+	copy(pk.id[:], b[2:10])
+	pk.key = ed25519.PublicKey(b[10:])
+	return pk, nil
+}
+
+// loadPublicKey parses key as a minisign public key, or if that fails, reads
+// it from the file at key.
+func loadPublicKey(key string) (publicKey, error) {
+	if pk, err := parsePublicKey(key); err == nil {
+		return pk, nil
+	}
+	data, err := ioutil.ReadFile(key)
+	if err != nil {
+		return publicKey{}, fmt.Errorf("%q is neither a public key nor a readable file: %v", key, err)
+	}
+	return parsePublicKey(string(data))
+}
+
+// signedAt returns the timestamp in a trusted comment.
+func signedAt(trustedComment string) (time.Time, error) {
+	for _, field := range strings.Fields(trustedComment) {
+		if !strings.HasPrefix(field, "timestamp:") {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimPrefix(field, "timestamp:"), 10, 64)
+		if err != nil || secs <= 0 {
+			return time.Time{}, fmt.Errorf("bad timestamp %q in trusted comment", field)
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, errors.New("trusted comment has no timestamp")
+}
+
+// verifySignature checks that sig is a valid minisign signature of data made
+// with one of trusted, and returns the ID of the key that made it, along with
+// the timestamp in its trusted comment.
+func verifySignature(trusted []publicKey, data []byte, sig []byte) (id keyID, at time.Time, err error) {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 {
+		return keyID{}, time.Time{}, errors.New("bad signature file: too few lines")
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return keyID{}, time.Time{}, fmt.Errorf("bad signature file: %v", err)
+	}
+	if len(sigBytes) != 2+8+ed25519.SignatureSize {
+		return keyID{}, time.Time{}, errors.New("bad signature file: unexpected signature length")
+	}
+	trustedComment := strings.TrimSpace(lines[2])
+	if !strings.HasPrefix(trustedComment, "trusted comment: ") {
+		return keyID{}, time.Time{}, errors.New("bad signature file: missing trusted comment")
+	}
+	trustedComment = strings.TrimPrefix(trustedComment, "trusted comment: ")
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return keyID{}, time.Time{}, fmt.Errorf("bad signature file: %v", err)
+	}
+	if len(globalSig) != ed25519.SignatureSize {
+		return keyID{}, time.Time{}, errors.New("bad signature file: unexpected global signature length")
+	}
+
+	var alg [2]byte
+	copy(alg[:], sigBytes[:2])
+	copy(id[:], sigBytes[2:10])
+	signature := sigBytes[10:]
+
+	message := data
+	switch alg {
+	case sigAlgEd:
+	case sigAlgPrehashed:
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return keyID{}, time.Time{}, fmt.Errorf("bad signature file: unsupported algorithm %q", alg[:])
+	}
+
+	for _, pk := range trusted {
+		if pk.id != id {
+			continue
+		}
+		if !ed25519.Verify(pk.key, message, signature) {
+			return keyID{}, time.Time{}, fmt.Errorf("signature by key %s doesn't match config", id)
+		}
+		if !ed25519.Verify(pk.key, append(append([]byte(nil), signature...), trustedComment...), globalSig) {
+			return keyID{}, time.Time{}, fmt.Errorf("trusted comment signature by key %s is invalid", id)
+		}
+		if at, err = signedAt(trustedComment); err != nil {
+			return keyID{}, time.Time{}, err
+		}
+		return id, at, nil
+	}
+	return keyID{}, time.Time{}, fmt.Errorf("config is signed by untrusted key %s", id)
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+type testSigner struct {
+	id   keyID
+	priv ed25519.PrivateKey
+	pub  string
+}
+
+func newTestSigner(t *testing.T) testSigner {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testSigner{priv: priv}
+	copy(s.id[:], "testkey1")
+	s.pub = base64.StdEncoding.EncodeToString(append(append(sigAlgEd[:], s.id[:]...), pub...))
+	return s
+}
+
+// sign returns a minisign signature of data with trustedComment.
+func (s testSigner) sign(data []byte, trustedComment string) []byte {
+	signature := ed25519.Sign(s.priv, data)
+	globalSig := ed25519.Sign(s.priv, append(append([]byte(nil), signature...), trustedComment...))
+	return []byte(fmt.Sprintf("untrusted comment: test\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append(sigAlgEd[:], s.id[:]...), signature...)),
+		trustedComment,
+		base64.StdEncoding.EncodeToString(globalSig)))
+}
+
+func TestSignatureFreshness(t *testing.T) {
+	signer := newTestSigner(t)
+	dir, err := ioutil.TempDir("", "vpnroutesd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, "cache")
+	if err = os.Mkdir(cacheDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(dir, "vpnroutesd.toml")
+
+	steps := []struct {
+		name           string
+		ip             string
+		trustedComment string
+		// want is the IP of the loaded config, and stale whether it's the
+		// cached copy.
+		want  string
+		stale bool
+		// restart loads with a new Loader, as if vpnroutesd restarted.
+		restart bool
+	}{
+		{
+			name:           "first",
+			ip:             "10.0.0.1",
+			trustedComment: "timestamp:1606780800\tfile:vpnroutesd.toml",
+			want:           "10.0.0.1",
+		},
+		{
+			name:           "newer",
+			ip:             "10.0.0.2",
+			trustedComment: "timestamp:1606867200\tfile:vpnroutesd.toml",
+			want:           "10.0.0.2",
+		},
+		{
+			name:           "replayed",
+			ip:             "10.0.0.1",
+			trustedComment: "timestamp:1606780800\tfile:vpnroutesd.toml",
+			want:           "10.0.0.2",
+			stale:          true,
+		},
+		{
+			name:           "replayed after a restart",
+			ip:             "10.0.0.1",
+			trustedComment: "timestamp:1606780800\tfile:vpnroutesd.toml",
+			want:           "10.0.0.2",
+			stale:          true,
+			restart:        true,
+		},
+		{
+			name:           "no timestamp",
+			ip:             "10.0.0.3",
+			trustedComment: "file:vpnroutesd.toml",
+			want:           "10.0.0.2",
+			stale:          true,
+		},
+		{
+			name:           "signed at the same time",
+			ip:             "10.0.0.2",
+			trustedComment: "timestamp:1606867200\tfile:vpnroutesd.toml",
+			want:           "10.0.0.2",
+		},
+	}
+
+	var loader *Loader
+	for _, step := range steps {
+		if loader == nil || step.restart {
+			if loader, err = NewLoader(LoaderOptions{CacheDir: cacheDir, TrustedKeys: []string{signer.pub}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := []byte(fmt.Sprintf("[vpnroutes]\nIPs = [%q]\n", step.ip))
+		if err = ioutil.WriteFile(source, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(source+signatureSuffix, signer.sign(data, step.trustedComment), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, _, err := loader.Load(context.Background(), zap.NewNop(), []string{source})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if len(cfg.VPNIPs) != 1 || cfg.VPNIPs[0].String() != step.want {
+			t.Errorf("%s: got IPs %v, want %s", step.name, cfg.VPNIPs, step.want)
+		}
+		if stale := cfg.Sources[0].Stale; stale != step.stale {
+			t.Errorf("%s: got stale %v, want %v", step.name, stale, step.stale)
+		}
+	}
+}
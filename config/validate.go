@@ -0,0 +1,409 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"go.uber.org/zap"
+)
+
+// CurrentVersion is the newest config schema version this vpnroutesd
+// understands.
+//
+// Configs without a Version are parsed leniently the way they always have
+// been: keys are matched case-insensitively, and unknown keys and invalid
+// entries are logged and ignored. Configs with a Version are parsed strictly:
+// any problem rejects the whole config.
+const CurrentVersion = 1
+
+// ValidationError is a problem found in a config file, along with where it
+// was found. Line and Col are 1-indexed, and are 0 if unknown. Positions of
+// entries in a list point at the list's key.
+type ValidationError struct {
+	Source string
+	Line   int
+	Col    int
+	Msg    string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line <= 0 {
+		return fmt.Sprintf("%s: %s", e.Source, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.Source, e.Line, e.Col, e.Msg)
+}
+
+// ValidationErrors is a list of problems found in a config file.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, ve := range e {
+		msgs = append(msgs, ve.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type fieldKind int
+
+const (
+	kindInt fieldKind = iota
+	kindString
+	kindStringList
+	kindTable
+	// kindTableMap is a table whose keys are names picked by the user, and
+	// whose values are tables with the same fields.
+	kindTableMap
+)
+
+func (k fieldKind) String() string {
+	switch k {
+	case kindInt:
+		return "an integer"
+	case kindString:
+		return "a string"
+	case kindStringList:
+		return "a list of strings"
+	case kindTable:
+		return "a table"
+	case kindTableMap:
+		return "a table of tables"
+	default:
+		return "unknown"
+	}
+}
+
+type schemaField struct {
+	kind   fieldKind
+	fields map[string]schemaField // only for kindTable and kindTableMap
+	// validateKey checks keys of a kindTableMap.
+	validateKey func(key string) error
+}
+
+// healthFields are the keys of the Health table and of each group's.
+var healthFields = map[string]schemaField{
+	"TCP":       {kind: kindStringList},
+	"DNS":       {kind: kindStringList},
+	"ICMP":      {kind: kindStringList},
+	"Timeout":   {kind: kindString},
+	"OnFailure": {kind: kindString},
+}
+
+// routesFields are the keys of the vpnroutes table and of each group.
+var routesFields = map[string]schemaField{
+	"Domains":       {kind: kindStringList},
+	"IPs":           {kind: kindStringList},
+	"CIDRs":         {kind: kindStringList},
+	"RemoveDomains": {kind: kindStringList},
+	"RemoveIPs":     {kind: kindStringList},
+	"RemoveCIDRs":   {kind: kindStringList},
+	"MTU":           {kind: kindInt},
+	"AdvMSS":        {kind: kindInt},
+	"Metric":        {kind: kindInt},
+	"Attributes": {kind: kindTableMap, validateKey: func(key string) error {
+		_, err := validateEntry(key)
+		return err
+	}, fields: map[string]schemaField{
+		"MTU":    {kind: kindInt},
+		"AdvMSS": {kind: kindInt},
+		"Metric": {kind: kindInt},
+	}},
+}
+
+// withFields returns a copy of fields with extra added.
+func withFields(fields map[string]schemaField, extra map[string]schemaField) map[string]schemaField {
+	merged := make(map[string]schemaField, len(fields)+len(extra))
+	for name, f := range fields {
+		merged[name] = f
+	}
+	for name, f := range extra {
+		merged[name] = f
+	}
+	return merged
+}
+
+// schema lists every key a config file can have, in canonical casing.
+var schema = map[string]schemaField{
+	"Version":   {kind: kindInt},
+	"Include":   {kind: kindStringList},
+	"DNSServer": {kind: kindString},
+	"Timeouts": {kind: kindTable, fields: map[string]schemaField{
+		"Config": {kind: kindString},
+		"DNS":    {kind: kindString},
+		"Routes": {kind: kindString},
+	}},
+	"Health":    {kind: kindTable, fields: healthFields},
+	"vpnroutes": {kind: kindTable, fields: routesFields},
+	"groups": {kind: kindTableMap, validateKey: validateGroupName, fields: withFields(routesFields, map[string]schemaField{
+		"Interface":        {kind: kindString},
+		"InterfacePattern": {kind: kindString},
+		"VPNServer":        {kind: kindString},
+		"Health":           {kind: kindTable, fields: healthFields},
+	})},
+}
+
+var reTOMLErrorPosition = regexp.MustCompile(`^\((\d+), (\d+)\): (.*)$`)
+
+// syntaxError converts an error from go-toml into a ValidationError.
+func syntaxError(source string, err error) ValidationError {
+	matches := reTOMLErrorPosition.FindStringSubmatch(err.Error())
+	if len(matches) == 0 {
+		return ValidationError{Source: source, Msg: err.Error()}
+	}
+	line, _ := strconv.Atoi(matches[1])
+	col, _ := strconv.Atoi(matches[2])
+	return ValidationError{Source: source, Line: line, Col: col, Msg: matches[3]}
+}
+
+func matchesKind(v interface{}, kind fieldKind) bool {
+	switch kind {
+	case kindInt:
+		_, ok := v.(int64)
+		return ok
+	case kindString:
+		_, ok := v.(string)
+		return ok
+	case kindStringList:
+		switch l := v.(type) {
+		case []string:
+			return true
+		case []interface{}:
+			for _, item := range l {
+				if _, ok := item.(string); !ok {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	case kindTable, kindTableMap:
+		_, ok := v.(*toml.Tree)
+		return ok
+	}
+	return false
+}
+
+// schemaChecker walks a parsed config and compares it against schema.
+type schemaChecker struct {
+	source   string
+	problems ValidationErrors
+	// positions maps canonical key paths, joined by ".", to where the key is
+	// in the file.
+	positions map[string]toml.Position
+}
+
+func (c *schemaChecker) add(pos toml.Position, format string, args ...interface{}) {
+	c.problems = append(c.problems, ValidationError{
+		Source: c.source,
+		Line:   pos.Line,
+		Col:    pos.Col,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *schemaChecker) check(tree *toml.Tree, fields map[string]schemaField, prefix string) {
+	keys := tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		pos := tree.GetPosition(key)
+		canonical, field, ok := key, schemaField{}, false
+		if field, ok = fields[key]; !ok {
+			for name, f := range fields {
+				if strings.EqualFold(name, key) {
+					canonical, field, ok = name, f, true
+					c.add(pos, "key %s%s should be spelled %s%s", prefix, key, prefix, name)
+					break
+				}
+			}
+		}
+		if !ok {
+			c.add(pos, "unknown key %s%s", prefix, key)
+			continue
+		}
+		c.positions[prefix+canonical] = pos
+		value := tree.Get(key)
+		if !matchesKind(value, field.kind) {
+			c.add(pos, "%s%s should be %s", prefix, canonical, field.kind)
+			continue
+		}
+		switch field.kind {
+		case kindTable:
+			c.check(value.(*toml.Tree), field.fields, prefix+canonical+".")
+		case kindTableMap:
+			c.checkTableMap(value.(*toml.Tree), field, prefix+canonical+".")
+		}
+	}
+}
+
+// checkTableMap checks each table in tree against field.fields. Keys of tree
+// are names, so they are kept as they are rather than canonicalized. They may
+// contain dots, e.g. domain names, so they're looked up as a single path
+// element.
+func (c *schemaChecker) checkTableMap(tree *toml.Tree, field schemaField, prefix string) {
+	keys := tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		pos := tree.GetPositionPath([]string{key})
+		c.positions[prefix+key] = pos
+		if err := field.validateKey(key); err != nil {
+			c.add(pos, "invalid name %s%s (%v)", prefix, key, err)
+			continue
+		}
+		sub, ok := tree.GetPath([]string{key}).(*toml.Tree)
+		if !ok {
+			c.add(pos, "%s%s should be a table", prefix, key)
+			continue
+		}
+		c.check(sub, field.fields, prefix+key+".")
+	}
+}
+
+func (c *schemaChecker) position(path string) toml.Position {
+	return c.positions[path]
+}
+
+// maxDomainLength is the maximum length of a domain name in text form, without
+// the trailing dot.
+const maxDomainLength = 253
+
+var reDomainLabel = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?$`)
+
+// ValidateDomain checks domain is a syntactically valid domain name. Configs
+// and domain overrides made through the control API are held to it.
+func ValidateDomain(domain string) error {
+	d := strings.TrimSuffix(domain, ".")
+	if len(d) == 0 {
+		return fmt.Errorf("empty domain name")
+	}
+	if len(d) > maxDomainLength {
+		return fmt.Errorf("domain name %q is longer than %d characters", domain, maxDomainLength)
+	}
+	for _, label := range strings.Split(d, ".") {
+		if !reDomainLabel.MatchString(label) {
+			return fmt.Errorf("%q is not a valid domain name", domain)
+		}
+	}
+	return nil
+}
+
+func validateIP(ipStr string) (net.IP, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP: %s", ipStr)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("non-IPv4 IP: %v", ip)
+	}
+	return ip, nil
+}
+
+func validateCIDR(cidrStr string) (*net.IPNet, error) {
+	_, cidr, err := net.ParseCIDR(cidrStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %s", cidrStr)
+	}
+	if cidr.IP.To4() == nil {
+		return nil, fmt.Errorf("non-IPv4 CIDR: %v", cidr)
+	}
+	return cidr, nil
+}
+
+func validateDuration(durationStr string) (time.Duration, error) {
+	d, err := time.ParseDuration(durationStr)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s (use a positive duration like \"30s\")", durationStr)
+	}
+	return d, nil
+}
+
+// validateHostPort checks hostPort is an IPv4 address and a port.
+func validateHostPort(hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return fmt.Errorf("invalid host:port: %s", hostPort)
+	}
+	if _, err = validateIP(host); err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %s", hostPort)
+	}
+	return nil
+}
+
+var reGroupName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateGroupName(name string) error {
+	if !reGroupName.MatchString(name) {
+		return fmt.Errorf("use letters, digits, '-' and '_'")
+	}
+	return nil
+}
+
+// validateEntry checks entry is a domain, IP or CIDR, and returns the key
+// RouteAttributes of the entry are kept under.
+func validateEntry(entry string) (key string, err error) {
+	if strings.Contains(entry, "/") {
+		cidr, err := validateCIDR(entry)
+		if err != nil {
+			return "", err
+		}
+		return cidr.String(), nil
+	}
+	if net.ParseIP(entry) != nil {
+		ip, err := validateIP(entry)
+		if err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	}
+	if err = ValidateDomain(entry); err != nil {
+		return "", fmt.Errorf("not a domain, IP or CIDR")
+	}
+	return normalizeDomain(entry), nil
+}
+
+const (
+	minMTU = 68
+	maxMTU = 65535
+)
+
+func validateFailurePolicy(policy string) (FailurePolicy, error) {
+	switch p := FailurePolicy(policy); p {
+	case FailureKeep, FailureWithdraw, FailureReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid OnFailure: %s (use %q, %q or %q)", policy, FailureKeep, FailureWithdraw, FailureReject)
+}
+
+// Validate strictly checks the config file data loaded from source, and
+// returns a ValidationErrors listing every problem found, or nil if there's
+// none. Unlike Loader.Load, it doesn't tolerate any problem even if the config
+// doesn't have a Version. Included files are not checked.
+func Validate(source string, data []byte) error {
+	_, problems, err := parseLayer(source, data)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// ValidateSource fetches the config file at p, which can be any kind of source
+// Load accepts, and validates it with Validate.
+func (l *Loader) ValidateSource(ctx context.Context, logger *zap.Logger, p string) error {
+	data, err := l.readConfig(ctx, logger, p)
+	if err != nil {
+		return fmt.Errorf("reading config file %s error: %v", p, err)
+	}
+	return Validate(p, data)
+}
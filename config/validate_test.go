@@ -0,0 +1,64 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAttributesSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		problem string
+	}{
+		{
+			name: "MTU",
+			data: `[vpnroutes]
+			MTU = 1380
+			[vpnroutes.Attributes."10.0.0.1"]
+			MTU = 1280`,
+		},
+		{
+			name: "MTU out of range",
+			data: `[vpnroutes]
+			MTU = 40`,
+			problem: "vpnroutes.MTU should be between",
+		},
+		{
+			name: "AdvMSS",
+			data: `[vpnroutes]
+			AdvMSS = 1340`,
+		},
+		{
+			name: "AdvMSS out of range",
+			data: `[vpnroutes]
+			AdvMSS = 65535`,
+			problem: "vpnroutes.AdvMSS should be between",
+		},
+		{
+			name: "Metric of an entry",
+			data: `[groups.lab]
+			Interface = "en5"
+			[groups.lab.Attributes."10.0.0.1"]
+			Metric = 10`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, problems, err := parseLayer("test", []byte(test.data))
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			if len(test.problem) == 0 {
+				if len(problems) > 0 {
+					t.Errorf("unexpected problems: %v", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0].Msg, test.problem) {
+				t.Errorf("got problems %v, want one about %q", problems, test.problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// watchDebounce is how long Watcher waits for more events after a change
+// before calling onChange. Editors often generate several events for a single
+// save.
+const watchDebounce = 250 * time.Millisecond
+
+// IsLocalSource returns true if p is a filesystem path rather than a remote
+// source.
+func IsLocalSource(p string) bool {
+	return sourceType(p) == "file"
+}
+
+// watchedFile is a local config file being watched.
+type watchedFile struct {
+	path string
+	// target is what path resolves to after following symlinks.
+	target string
+}
+
+// Watcher watches local config files, and calls onChange soon after any of
+// them changes. Since editors often save by writing a new file and renaming it
+// over the old one, and Kubernetes ConfigMaps update by swapping a symlink,
+// it watches the directories containing the files rather than the files
+// themselves, and it follows symlinks.
+type Watcher struct {
+	logger   *zap.Logger
+	onChange func()
+	watcher  *fsnotify.Watcher
+
+	lock  sync.Mutex
+	files []watchedFile
+	dirs  map[string]bool
+	timer *time.Timer
+}
+
+// NewWatcher creates a Watcher. Call SetSources to tell it what to watch.
+func NewWatcher(logger *zap.Logger, onChange func()) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		logger:   logger,
+		onChange: onChange,
+		watcher:  fw,
+		dirs:     make(map[string]bool),
+	}
+	go w.loop()
+	return w, nil
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func resolveTarget(p string) string {
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+// SetSources replaces the set of watched files with the local ones in
+// sources. Remote sources are ignored.
+func (w *Watcher) SetSources(sources []string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.files = w.files[:0]
+	for _, source := range sources {
+		if !IsLocalSource(source) {
+			continue
+		}
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			w.logger.Sugar().Warnf("not watching config %s: %v", source, err)
+			continue
+		}
+		w.files = append(w.files, watchedFile{path: abs, target: resolveTarget(abs)})
+	}
+	w.updateDirsLocked()
+}
+
+func (w *Watcher) updateDirsLocked() {
+	wanted := make(map[string]bool)
+	for _, f := range w.files {
+		wanted[filepath.Dir(f.path)] = true
+		if len(f.target) > 0 {
+			wanted[filepath.Dir(f.target)] = true
+		}
+	}
+	for dir := range w.dirs {
+		if !wanted[dir] {
+			w.watcher.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+	for dir := range wanted {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			w.logger.Sugar().Warnf("failed to watch %s: %v", dir, err)
+			continue
+		}
+		w.logger.Sugar().Debugf("watching %s for config changes", dir)
+		w.dirs[dir] = true
+	}
+}
+
+// relevantLocked returns true if event affects any watched file, and updates
+// symlink targets of watched files along the way.
+func (w *Watcher) relevantLocked(event fsnotify.Event) (relevant bool) {
+	name := filepath.Clean(event.Name)
+	targetsChanged := false
+	for i, f := range w.files {
+		if name == f.path || name == f.target {
+			relevant = true
+		}
+		if target := resolveTarget(f.path); target != f.target {
+			w.files[i].target = target
+			relevant, targetsChanged = true, true
+		}
+	}
+	if targetsChanged {
+		w.updateDirsLocked()
+	}
+	return relevant
+}
+
+func (w *Watcher) loop() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.lock.Lock()
+			if w.relevantLocked(event) {
+				w.logger.Sugar().Debugf("config file event: %s", event)
+				if w.timer != nil {
+					w.timer.Stop()
+				}
+				w.timer = time.AfterFunc(watchDebounce, w.onChange)
+			}
+			w.lock.Unlock()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Sugar().Warnf("config watcher error: %v", err)
+		}
+	}
+}
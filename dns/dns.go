@@ -1,12 +1,24 @@
 package dns
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/songgao/vpnroutesd/metrics"
 	"go.uber.org/zap"
 )
 
-var lastIPs []net.IP
+// Record is a remembered IP address for a domain, along with the time it
+// expires at.
+type Record struct {
+	IP        net.IP
+	ExpiresAt time.Time
+}
 
 func sameIPs(a, b []net.IP) bool {
 	if len(a) != len(b) {
@@ -24,18 +36,129 @@ func sameIPs(a, b []net.IP) bool {
 	return true
 }
 
+// Resolver resolves VPN domains to IPs. It remembers records it has seen, and
+// what it returned last time, to tell whether the IPs have changed between
+// calls to GetIPs.
+type Resolver struct {
+	opts     ResolverOptions
+	resolver *resolver
+
+	lock    sync.Mutex
+	lastIPs []net.IP
+}
+
+const (
+	defaultWorkers      = 16
+	defaultQueryTimeout = 2 * time.Second
+)
+
+// ResolverOptions configures a Resolver.
+type ResolverOptions struct {
+	// Workers is the maximum number of domains looked up at the same time.
+	// Defaults to 16.
+	Workers int
+	// QueryTimeout limits how long a single DNS query can take. Defaults to
+	// 2s.
+	QueryTimeout time.Duration
+}
+
+// NewResolver creates a Resolver.
+func NewResolver(opts ResolverOptions) *Resolver {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultWorkers
+	}
+	if opts.QueryTimeout <= 0 {
+		opts.QueryTimeout = defaultQueryTimeout
+	}
+	return &Resolver{
+		opts:     opts,
+		resolver: newResolver(opts.QueryTimeout),
+	}
+}
+
+// LookupErrors maps domains that failed to resolve to why.
+type LookupErrors map[string]error
+
+func (e LookupErrors) Error() string {
+	domains := make([]string, 0, len(e))
+	for domain := range e {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	if len(domains) > 3 {
+		return fmt.Sprintf("%d domains failed to resolve: %s, ...", len(domains), strings.Join(domains[:3], ", "))
+	}
+	return fmt.Sprintf("%d domains failed to resolve: %s", len(domains), strings.Join(domains, ", "))
+}
+
 // GetIPs returns IP address for domains. The IP address include both currently
 // resolved addresses from the DNS, and any addresses from previously seen
 // records that haven't expired.
-func GetIPs(logger *zap.Logger, dnsServer net.IP, domains []string) (ips []net.IP, changed bool, err error) {
+//
+// A domain that fails to resolve doesn't stop other domains from being
+// resolved, and its remembered addresses are still returned. If any domain
+// fails, including because ctx is done before it's looked up, err is a
+// LookupErrors listing them.
+//
+// Up to Workers domains are looked up concurrently.
+func (r *Resolver) GetIPs(ctx context.Context, logger *zap.Logger, dnsServer net.IP, domains []string) (ips []net.IP, changed bool, err error) {
 	logger.Debug("+ GetIPs")
 	defer logger.Debug("- GetIPs")
+	byDomain, changed, err := r.GetIPsByDomain(ctx, logger, dnsServer, domains)
 	for _, domain := range domains {
-		domainIPs := theResolver.get(logger, dnsServer, domain)
+		ips = append(ips, byDomain[domain]...)
+	}
+	return ips, changed, err
+}
+
+// GetIPsByDomain is like GetIPs, but returns IP addresses for each domain
+// separately, keyed by the domain as it's passed in.
+func (r *Resolver) GetIPsByDomain(ctx context.Context, logger *zap.Logger, dnsServer net.IP, domains []string) (byDomain map[string][]net.IP, changed bool, err error) {
+	metrics.DomainResolvedIPs.Reset()
+
+	type lookupResult struct {
+		ips []net.IP
+		err error
+	}
+	results := make([]lookupResult, len(domains))
+	sem := make(chan struct{}, r.opts.Workers)
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		go func(i int, domain string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i].ips, results[i].err = r.resolver.get(ctx, logger, dnsServer, domain)
+		}(i, domain)
+	}
+	wg.Wait()
+
+	failed := make(LookupErrors)
+	byDomain = make(map[string][]net.IP, len(domains))
+	var ips []net.IP
+	for i, domain := range domains {
+		domainIPs := results[i].ips
+		if results[i].err != nil {
+			failed[domain] = results[i].err
+		}
 		logger.Sugar().Debugf("resolved IPs for %s: %s", domain, domainIPs)
+		metrics.DomainResolvedIPs.Set(float64(len(domainIPs)), domain)
+		byDomain[domain] = domainIPs
 		ips = append(ips, domainIPs...)
 	}
-	changed = !sameIPs(lastIPs, ips)
-	lastIPs = ips
-	return ips, changed, nil
+	r.lock.Lock()
+	changed = !sameIPs(r.lastIPs, ips)
+	r.lastIPs = ips
+	r.lock.Unlock()
+	if len(failed) > 0 {
+		return byDomain, changed, failed
+	}
+	return byDomain, changed, nil
+}
+
+// Records returns all remembered records, keyed by domain name (without the
+// trailing dot).
+func (r *Resolver) Records() map[string][]Record {
+	return r.resolver.records()
 }
@@ -1,12 +1,15 @@
 package dns
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/songgao/vpnroutesd/metrics"
 	"go.uber.org/zap"
 )
 
@@ -37,43 +40,78 @@ func ipToArray(ip net.IP) ipv4Addr {
 
 type resolverDomain map[ipv4Addr]time.Time
 
+// resolver remembers records per domain. Queries to the DNS server are made
+// without holding lock, so domains can be looked up concurrently; only merging
+// answers into domainToIPs is done under lock.
 type resolver struct {
+	queryTimeout time.Duration
+
 	lock        sync.Mutex
 	domainToIPs map[string]resolverDomain
 }
 
-var theResolver = resolver{
-	domainToIPs: make(map[string]resolverDomain),
+func newResolver(queryTimeout time.Duration) *resolver {
+	return &resolver{
+		queryTimeout: queryTimeout,
+		domainToIPs:  make(map[string]resolverDomain),
+	}
 }
 
-func (r *resolver) lookupLocked(logger *zap.Logger, dnsServer string, domain string) {
-	if _, ok := r.domainToIPs[domain]; !ok {
-		r.domainToIPs[domain] = make(resolverDomain)
-	}
+// query asks dnsServer for A records of domain. It returns an error if the
+// query failed, or the server couldn't answer it. NXDOMAIN isn't an error
+// since it's a real answer.
+func (r *resolver) query(ctx context.Context, logger *zap.Logger, dnsServer string, domain string) ([]*dns.A, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.queryTimeout)
+	defer cancel()
 	m := &dns.Msg{}
 	m.SetQuestion(domain, dns.TypeA)
-	res, err := dns.Exchange(m, dnsServer)
+	start := time.Now()
+	res, _, err := (&dns.Client{Timeout: r.queryTimeout}).ExchangeContext(ctx, m, dnsServer)
+	metrics.DNSQueryDuration.ObserveSince(start, dnsServer)
 	if err != nil {
+		metrics.DNSQueryFailures.Inc(dnsServer)
 		logger.Sugar().Warnf("dns look up for %s failed: %v", domain, err)
-		return
+		return nil, err
+	}
+	switch res.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		logger.Sugar().Warnf("dns look up for %s: no such domain", domain)
+		return nil, nil
+	default:
+		metrics.DNSQueryFailures.Inc(dnsServer)
+		logger.Sugar().Warnf("dns look up for %s failed: %s", domain, dns.RcodeToString[res.Rcode])
+		return nil, fmt.Errorf("DNS server responded %s", dns.RcodeToString[res.Rcode])
 	}
+	var answers []*dns.A
 	for _, answer := range res.Answer {
 		if a, ok := answer.(*dns.A); ok {
-			ip := a.A.To4()
-			if ip == nil {
-				logger.Sugar().Warnf("unexpected non-IPv4 result returned as A record")
-				continue
-			}
-			ipArray := ipToArray(ip)
-			expiresAt := time.Now().Add(time.Duration(a.Hdr.Ttl) * time.Second)
-			if existingExpireAt, ok := r.domainToIPs[domain][ipArray]; ok && existingExpireAt.After(expiresAt) {
-				// don't shorten TTL
-				continue
-			}
-			r.domainToIPs[domain][ipArray] = expiresAt
-			logger.Sugar().Debugf("added resolver item: %s -> %s [expires at %s]", domain, ip, expiresAt.Format(time.RFC3339))
+			answers = append(answers, a)
 		}
 	}
+	return answers, nil
+}
+
+// rememberLocked merges answers for domain into what's remembered.
+func (r *resolver) rememberLocked(logger *zap.Logger, domain string, answers []*dns.A) {
+	if _, ok := r.domainToIPs[domain]; !ok {
+		r.domainToIPs[domain] = make(resolverDomain)
+	}
+	for _, a := range answers {
+		ip := a.A.To4()
+		if ip == nil {
+			logger.Sugar().Warnf("unexpected non-IPv4 result returned as A record")
+			continue
+		}
+		ipArray := ipToArray(ip)
+		expiresAt := time.Now().Add(time.Duration(a.Hdr.Ttl) * time.Second)
+		if existingExpireAt, ok := r.domainToIPs[domain][ipArray]; ok && existingExpireAt.After(expiresAt) {
+			// don't shorten TTL
+			continue
+		}
+		r.domainToIPs[domain][ipArray] = expiresAt
+		logger.Sugar().Debugf("added resolver item: %s -> %s [expires at %s]", domain, ip, expiresAt.Format(time.RFC3339))
+	}
 }
 
 func (r *resolver) purgeExpiredLocked(logger *zap.Logger) {
@@ -94,26 +132,48 @@ func (r *resolver) purgeExpiredLocked(logger *zap.Logger) {
 	}
 }
 
-func (r *resolver) get(logger *zap.Logger, dnsServer net.IP, domain string) []net.IP {
+// get looks up domain, and returns its IPs from both the answer and
+// remembered records that haven't expired. If the lookup fails, remembered IPs
+// are still returned along with the error. It's safe to call concurrently.
+func (r *resolver) get(ctx context.Context, logger *zap.Logger, dnsServer net.IP, domain string) ([]net.IP, error) {
 	logger.Sugar().Debugf("using %s for DNS lookups", dnsServer.String())
 	if !strings.HasSuffix(domain, ".") {
 		domain = domain + "."
 	}
+
+	var answers []*dns.A
+	err := ctx.Err()
+	if err == nil {
+		answers, err = r.query(ctx, logger, net.JoinHostPort(dnsServer.String(), "53"), domain)
+	}
+
 	r.lock.Lock()
 	defer r.lock.Unlock()
-
-	r.lookupLocked(logger, net.JoinHostPort(dnsServer.String(), "53"), domain)
+	r.rememberLocked(logger, domain, answers)
 	r.purgeExpiredLocked(logger)
 
-	dr, ok := r.domainToIPs[domain]
-	if !ok {
-		return nil
-	}
+	dr := r.domainToIPs[domain]
 	ret := make([]net.IP, 0, len(dr))
 	for ipArray := range dr {
 		ipCopy := make(net.IP, 4)
 		copy(ipCopy, ipArray[:])
 		ret = append(ret, ipCopy)
 	}
+	return ret, err
+}
+
+func (r *resolver) records() map[string][]Record {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := make(map[string][]Record, len(r.domainToIPs))
+	for domain, rd := range r.domainToIPs {
+		records := make([]Record, 0, len(rd))
+		for ipArray, expiresAt := range rd {
+			ipCopy := make(net.IP, 4)
+			copy(ipCopy, ipArray[:])
+			records = append(records, Record{IP: ipCopy, ExpiresAt: expiresAt})
+		}
+		ret[strings.TrimSuffix(domain, ".")] = records
+	}
 	return ret
 }
@@ -3,9 +3,11 @@ module github.com/songgao/vpnroutesd
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/miekg/dns v1.1.35
 	github.com/pelletier/go-toml v1.8.1
 	github.com/spf13/pflag v1.0.5
 	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb
 )
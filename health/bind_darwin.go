@@ -0,0 +1,20 @@
+package health
+
+import (
+	"syscall"
+)
+
+// bindToInterface returns a Control function that makes sockets send packets
+// through the interface at index, regardless of the routing table.
+func bindToInterface(index int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, index)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
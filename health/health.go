@@ -0,0 +1,218 @@
+// Package health probes whether a VPN works, by sending traffic through its
+// interface regardless of what the routing table says.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/songgao/vpnroutesd/config"
+	"github.com/songgao/vpnroutesd/metrics"
+	"github.com/songgao/vpnroutesd/sys"
+	"go.uber.org/zap"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// DefaultTimeout limits each probe if the config doesn't set a timeout.
+const DefaultTimeout = 3 * time.Second
+
+// probe is a single health probe.
+type probe struct {
+	kind   string // "tcp", "dns" or "icmp"
+	target string
+	run    func(ctx context.Context, vpn sys.Interface) error
+}
+
+func probes(hc config.HealthCheck) (ps []probe) {
+	for _, hostPort := range hc.TCP {
+		hostPort := hostPort
+		ps = append(ps, probe{"tcp", hostPort, func(ctx context.Context, vpn sys.Interface) error {
+			return probeTCP(ctx, vpn, hostPort)
+		}})
+	}
+	for _, server := range hc.DNS {
+		server := server
+		ps = append(ps, probe{"dns", server.String(), func(ctx context.Context, vpn sys.Interface) error {
+			return probeDNS(ctx, vpn, server)
+		}})
+	}
+	for _, host := range hc.ICMP {
+		host := host
+		ps = append(ps, probe{"icmp", host.String(), func(ctx context.Context, vpn sys.Interface) error {
+			return probeICMP(ctx, vpn, host)
+		}})
+	}
+	return ps
+}
+
+// Check sends the probes in hc through the vpn interface at the same time,
+// and returns nil if any of them succeeds. Otherwise, it returns an error
+// describing why each probe failed. It returns nil if hc has no probes.
+func Check(ctx context.Context, logger *zap.Logger, vpn sys.Interface, hc config.HealthCheck) error {
+	logger.Debug("+ health.Check")
+	defer logger.Debug("- health.Check")
+
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ps := probes(hc)
+	if len(ps) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(ps))
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			errs[i] = p.run(pctx, vpn)
+			if errs[i] != nil {
+				metrics.HealthProbes.Inc(p.kind, "failed")
+				logger.Sugar().Debugf("%s probe to %s through %s failed: %v", p.kind, p.target, vpn.Name, errs[i])
+				return
+			}
+			metrics.HealthProbes.Inc(p.kind, "ok")
+			logger.Sugar().Debugf("%s probe to %s through %s succeeded", p.kind, p.target, vpn.Name)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, p := range ps {
+		if errs[i] == nil {
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("%s %s: %v", p.kind, p.target, errs[i]))
+	}
+	return fmt.Errorf("all %d probes through %s failed: %s", len(ps), vpn.Name, strings.Join(failures, "; "))
+}
+
+func dialer(vpn sys.Interface, localAddr net.Addr) *net.Dialer {
+	return &net.Dialer{
+		LocalAddr: localAddr,
+		Control:   bindToInterface(vpn.Index),
+	}
+}
+
+func probeTCP(ctx context.Context, vpn sys.Interface, hostPort string) error {
+	conn, err := dialer(vpn, &net.TCPAddr{IP: vpn.IP}).DialContext(ctx, "tcp4", hostPort)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeDNS(ctx context.Context, vpn sys.Interface, server net.IP) error {
+	client := &dns.Client{
+		Net:    "udp",
+		Dialer: dialer(vpn, &net.UDPAddr{IP: vpn.IP}),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		client.Timeout = time.Until(deadline)
+	}
+	msg := &dns.Msg{}
+	msg.SetQuestion(".", dns.TypeNS)
+	// Any reply means the server is reachable, even if it refuses the query.
+	_, _, err := client.ExchangeContext(ctx, msg, net.JoinHostPort(server.String(), "53"))
+	return err
+}
+
+// lastEchoID is the ICMP echo ID of the last ICMP probe. Each probe takes the
+// next one, since the raw sockets of probes running at the same time all get
+// each other's replies, even when bound to different interfaces.
+var lastEchoID = uint32(os.Getpid())
+
+// unreachableEchoID returns the ID of the echo request that data, the body of
+// a destination unreachable message, quotes.
+func unreachableEchoID(data []byte) (int, bool) {
+	if len(data) < ipv4.HeaderLen {
+		return 0, false
+	}
+	ihl := int(data[0]&0x0f) << 2
+	if len(data) < ihl+8 || data[ihl] != byte(ipv4.ICMPTypeEcho) {
+		return 0, false
+	}
+	return int(data[ihl+4])<<8 | int(data[ihl+5]), true
+}
+
+func probeICMP(ctx context.Context, vpn sys.Interface, host net.IP) error {
+	lc := net.ListenConfig{Control: bindToInterface(vpn.Index)}
+	pc, err := lc.ListenPacket(ctx, "ip4:icmp", vpn.IP.String())
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = pc.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// Unblock reads if ctx is canceled before the deadline.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	id := int(atomic.AddUint32(&lastEchoID, 1) & 0xffff)
+	req := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("vpnroutesd")},
+	}
+	b, err := req.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err = pc.WriteTo(b, &net.IPAddr{IP: host}); err != nil {
+		return err
+	}
+
+	// The raw socket gets every ICMP message the host receives, so skip until
+	// we get the reply to ours.
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if addr, ok := peer.(*net.IPAddr); !ok || !addr.IP.Equal(host) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			continue
+		}
+		switch reply.Type {
+		case ipv4.ICMPTypeEchoReply:
+			if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == 1 {
+				return nil
+			}
+		case ipv4.ICMPTypeDestinationUnreachable:
+			if unreach, ok := reply.Body.(*icmp.DstUnreach); ok {
+				if echoID, ok := unreachableEchoID(unreach.Data); ok && echoID == id {
+					return errors.New("destination unreachable")
+				}
+			}
+		}
+	}
+}
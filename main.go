@@ -1,19 +1,58 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/songgao/vpnroutesd/config"
+	"github.com/songgao/vpnroutesd/dns"
+	"github.com/songgao/vpnroutesd/metrics"
+	"github.com/songgao/vpnroutesd/sys"
+	"github.com/songgao/vpnroutesd/vpnroutes"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 )
 
+var fValidate = pflag.Bool("validate", false, "[optional] strictly validate the config files passed with --config, print any problems, and exit")
 var fVerbose = pflag.BoolP("verbose", "v", false, "[optional] turn on debug logging")
 var fInterval = pflag.Uint64("interval", 60, "[optional] interval in seconds to do stuff. default is 60")
-var fConfig = pflag.StringP("config", "c", "", "[required] path to config file")
+var fConfig = pflag.StringArrayP("config", "c", nil, "[required] path to config file (repeat to merge multiple sources; later ones take precedence)")
+var fConfigCacheDir = pflag.String("config-cache-dir", "/var/db/vpnroutesd", "[optional] directory to cache the last known good config in, used when the config can't be loaded (set to empty to disable)")
+var fHTTPSConnectTimeout = pflag.Duration("https-connect-timeout", 10*time.Second, "[optional] timeout for connecting to an https:// config URL")
+var fHTTPSReadTimeout = pflag.Duration("https-read-timeout", 30*time.Second, "[optional] timeout for reading the response from an https:// config URL")
+var fHTTPSMaxBodySize = pflag.Int64("https-max-body-size", 1<<20, "[optional] maximum size in bytes of a config file fetched from an https:// URL")
+var fHTTPSBearerTokenFile = pflag.String("https-bearer-token-file", "", "[optional] file containing a bearer token for fetching https:// config URLs")
+var fHTTPSBasicAuthFile = pflag.String("https-basic-auth-file", "", "[optional] file containing <username>:<password> for fetching https:// config URLs")
+var fHTTPSCAFile = pflag.String("https-ca-file", "", "[optional] PEM CA bundle to verify https:// config URLs against instead of system roots")
+var fHTTPSClientCert = pflag.String("https-client-cert", "", "[optional] PEM client certificate for mutual TLS with https:// config URLs")
+var fHTTPSClientKey = pflag.String("https-client-key", "", "[optional] PEM client key for mutual TLS with https:// config URLs")
+var fTrustedKeys = pflag.StringArray("trusted-key", nil, "[optional] minisign public key, or path to a minisign .pub file, that configs must be signed with (repeat for multiple keys)")
+var fDNSWorkers = pflag.Int("dns-workers", 16, "[optional] maximum number of domains to look up concurrently")
+var fDNSQueryTimeout = pflag.Duration("dns-query-timeout", 2*time.Second, "[optional] timeout for a single DNS query")
+var fFlapDampingHalfLife = pflag.Duration("flap-damping-half-life", 0, "[optional] half-life of the flap damping penalty of IPs resolved from domains, e.g. 15m (0 disables flap damping)")
+var fFlapDampingMaxSuppress = pflag.Duration("flap-damping-max-suppress", 0, "[optional] maximum time flap damping keeps an IP routed after its domain stopped resolving to it (0 means 4 half-lives)")
 var fPrimaryIfce = pflag.StringP("primary-interface", "i", "", "[optional] primary interface name (leave empty to use auto detection)")
 var fVPNIfce = pflag.StringP("vpn-interface", "j", "", "[optional] VPN interface name (leave empty to use auto detection)")
+var fKillSwitch = pflag.Bool("kill-switch", false, "[optional] install reject routes for VPN destinations while the VPN interface is absent, so they never go through the primary interface")
+var fUnmanagedDefaultRoute = pflag.Bool("unmanaged-default-route", false, "[optional] leave the default route alone, e.g. to let a full tunnel VPN client own it, rather than keep it going through the primary interface")
+var fProtectDNSServer = pflag.Bool("protect-dns-server", true, "[optional] keep the config's DNSServer going through the primary interface even if a VPN CIDR covers it, unless it's listed under IPs on its own")
+var fRouteStateFile = pflag.String("route-state-file", "/var/db/vpnroutesd/routes.json", "[optional] file to record routes added by vpnroutesd in, so routes left on a previous VPN interface are cleaned up even after a restart (set to empty to disable)")
+var fMaxRoutes = pflag.Int("max-routes", 0, "[optional] refuse to apply route changes that would leave vpnroutesd managing more routes than this (0 disables)")
+var fMaxRouteAdds = pflag.Int("max-route-adds", 0, "[optional] refuse to add more routes than this in one iteration (0 disables)")
+var fMaxRouteDeletes = pflag.Int("max-route-deletes", 0, "[optional] refuse to delete more routes than this in one iteration (0 disables)")
+var fMaxRouteDeletePercent = pflag.Int("max-route-delete-percent", 0, "[optional] refuse to delete more than this percentage of current routes in one iteration (0 disables)")
+var fConfirmPlan = pflag.String("confirm-plan", "", "[optional] confirm route changes blocked by the limits above, by the plan ID in the logs or /v1/status, through the control API of a running vpnroutesd, and exit")
+var fControlSocket = pflag.String("control-socket", "/var/run/vpnroutesd.sock", "[optional] path to Unix socket for the control API (set to empty to disable)")
+var fControlGroup = pflag.String("control-group", "", "[optional] group allowed to use the control API in addition to root")
+var fMetricsListen = pflag.String("metrics-listen", "", "[optional] address to serve Prometheus metrics at /metrics on, e.g. 127.0.0.1:9273 (leave empty to disable)")
 
 func parseFlagsOrBust() {
 	pflag.Parse()
@@ -26,6 +65,9 @@ func parseFlagsOrBust() {
 		pflag.Usage()
 		os.Exit(1)
 	}
+	if len(*fConfirmPlan) > 0 {
+		return
+	}
 	if len(*fConfig) == 0 {
 		fmt.Fprintln(os.Stderr, "error: --config is required")
 		pflag.Usage()
@@ -33,8 +75,70 @@ func parseFlagsOrBust() {
 	}
 }
 
+// validateAndExit strictly validates each config source and exits with a
+// non-zero status if any problem is found.
+func validateAndExit(logger *zap.Logger, loader *config.Loader) {
+	ok := true
+	for _, p := range *fConfig {
+		err := loader.ValidateSource(context.Background(), logger, p)
+		switch e := err.(type) {
+		case nil:
+			fmt.Printf("%s: OK\n", p)
+		case config.ValidationErrors:
+			ok = false
+			for _, ve := range e {
+				fmt.Fprintln(os.Stderr, ve)
+			}
+		default:
+			ok = false
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// confirmPlanAndExit confirms a blocked plan through the control API of a
+// running vpnroutesd, and exits with a non-zero status if that fails.
+func confirmPlanAndExit() {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *fControlSocket)
+			},
+		},
+	}
+	body, err := json.Marshal(map[string]string{"plan": *fConfirmPlan})
+	if err != nil {
+		panic(err)
+	}
+	resp, err := client.Post("http://localhost/v1/routes/confirm", "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		fmt.Fprintf(os.Stderr, "confirming plan %s error: %s: %s\n", *fConfirmPlan, resp.Status, e.Error)
+		os.Exit(1)
+	}
+	fmt.Printf("plan %s confirmed; it will be applied if it's still the same\n", *fConfirmPlan)
+	os.Exit(0)
+}
+
 func main() {
 	parseFlagsOrBust()
+	if len(*fConfirmPlan) > 0 {
+		confirmPlanAndExit()
+	}
 
 	var options []zap.Option
 	if !*fVerbose {
@@ -46,17 +150,92 @@ func main() {
 	}
 	defer logger.Sync()
 
+	loaderOpts := config.LoaderOptions{
+		CacheDir: *fConfigCacheDir,
+		HTTPS: config.HTTPSOptions{
+			ConnectTimeout:  *fHTTPSConnectTimeout,
+			ReadTimeout:     *fHTTPSReadTimeout,
+			MaxBodySize:     *fHTTPSMaxBodySize,
+			BearerTokenFile: *fHTTPSBearerTokenFile,
+			BasicAuthFile:   *fHTTPSBasicAuthFile,
+			CAFile:          *fHTTPSCAFile,
+			ClientCertFile:  *fHTTPSClientCert,
+			ClientKeyFile:   *fHTTPSClientKey,
+		},
+		TrustedKeys: *fTrustedKeys,
+	}
+
+	if *fValidate {
+		loader, err := config.NewLoader(loaderOpts)
+		if err != nil {
+			logger.Sugar().Fatalf("creating config loader error: %v", err)
+		}
+		validateAndExit(logger, loader)
+	}
+
 	logger.Info("Init")
 
-	ticker := time.NewTicker(time.Duration(*fInterval) * time.Second)
-	first := make(chan struct{}, 1)
-	first <- struct{}{}
-	for {
-		select {
-		case <-ticker.C:
-		case <-first:
+	opts := vpnroutes.Options{
+		ConfigSources: *fConfig,
+		Loader:        loaderOpts,
+		DNS: dns.ResolverOptions{
+			Workers:      *fDNSWorkers,
+			QueryTimeout: *fDNSQueryTimeout,
+		},
+		Damping: vpnroutes.DampingOptions{
+			HalfLife:    *fFlapDampingHalfLife,
+			MaxSuppress: *fFlapDampingMaxSuppress,
+		},
+		Interval:              time.Duration(*fInterval) * time.Second,
+		WatchLocalConfig:      true,
+		KillSwitch:            *fKillSwitch,
+		ControlSocket:         *fControlSocket,
+		ControlGroup:          *fControlGroup,
+		UnmanagedDefaultRoute: *fUnmanagedDefaultRoute,
+		UnprotectedDNSServer:  !*fProtectDNSServer,
+		ChurnLimits: sys.ChurnLimits{
+			MaxRoutes:        *fMaxRoutes,
+			MaxAdds:          *fMaxRouteAdds,
+			MaxDeletes:       *fMaxRouteDeletes,
+			MaxDeletePercent: *fMaxRouteDeletePercent,
+		},
+		Router: sys.RouterOptions{
+			StateFile: *fRouteStateFile,
+		},
+	}
+	if len(*fPrimaryIfce) > 0 && len(*fVPNIfce) > 0 {
+		opts.Interfaces = &sys.InterfaceNames{
+			Primary: *fPrimaryIfce,
+			VPN:     *fVPNIfce,
 		}
-		results := run(logger)
-		logger.Sugar().Infof("Iteration: config [%s]; dns [%s]; routes [%s]", results.config, results.dns, results.routes)
+	}
+	d, err := vpnroutes.New(logger, opts)
+	if err != nil {
+		logger.Sugar().Fatalf("creating daemon error: %v", err)
+	}
+
+	if len(*fMetricsListen) > 0 {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			logger.Sugar().Infof("serving metrics on %s", *fMetricsListen)
+			if err := http.ListenAndServe(*fMetricsListen, mux); err != nil {
+				logger.Sugar().Errorf("metrics listener error: %v", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Sugar().Infof("received %s; shutting down", sig)
+		cancel()
+	}()
+
+	if err = d.Run(ctx); err != nil && err != context.Canceled {
+		logger.Sugar().Errorf("run error: %v", err)
 	}
 }
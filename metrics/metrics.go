@@ -0,0 +1,251 @@
+// Package metrics implements the handful of counters, gauges and histograms
+// vpnroutesd exports, along with an http.Handler that serves them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// DefaultBuckets are histogram buckets in seconds suitable for network
+// operations like DNS queries and config fetches.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type histogramValue struct {
+	counts []uint64 // one per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// metric is a family of time series sharing a name and label names.
+type metric struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+
+	lock       sync.Mutex
+	values     map[string]float64
+	histograms map[string]*histogramValue
+	labels     map[string][]string
+}
+
+func (m *metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values but got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := m.labels[key]; !ok {
+		m.labels[key] = append([]string(nil), labelValues...)
+	}
+	return key
+}
+
+func (m *metric) add(delta float64, labelValues []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[m.key(labelValues)] += delta
+}
+
+func (m *metric) set(value float64, labelValues []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[m.key(labelValues)] = value
+}
+
+func (m *metric) observe(value float64, labelValues []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := m.key(labelValues)
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogramValue{counts: make([]uint64, len(m.buckets))}
+		m.histograms[key] = h
+	}
+	for i, upper := range m.buckets {
+		if value <= upper {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (m *metric) reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values = make(map[string]float64)
+	m.histograms = make(map[string]*histogramValue)
+	m.labels = make(map[string][]string)
+	if len(m.labelNames) == 0 && m.typ != typeHistogram {
+		// Export unlabeled counters and gauges even before they are touched.
+		m.values[m.key(nil)] = 0
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i])))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+
+	keys := make([]string, 0, len(m.labels))
+	for key := range m.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labelValues := m.labels[key]
+		if m.typ != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labelNames, labelValues, "", ""), formatFloat(m.values[key]))
+			continue
+		}
+		h := m.histograms[key]
+		var cumulative uint64
+		for i, upper := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, labelValues, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labelNames, labelValues, "", ""), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labelNames, labelValues, "", ""), h.count)
+	}
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []*metric
+)
+
+func register(name string, help string, typ metricType, buckets []float64, labelNames []string) *metric {
+	m := &metric{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+	}
+	m.reset()
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, m)
+	return m
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ m *metric }
+
+// NewCounterVec creates and registers a CounterVec.
+func NewCounterVec(name string, help string, labelNames ...string) CounterVec {
+	return CounterVec{register(name, help, typeCounter, nil, labelNames)}
+}
+
+// Add adds delta, which must not be negative, to the counter identified by
+// labelValues.
+func (c CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.m.add(delta, labelValues)
+}
+
+// Inc increments the counter identified by labelValues by 1.
+func (c CounterVec) Inc(labelValues ...string) {
+	c.m.add(1, labelValues)
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ m *metric }
+
+// NewGaugeVec creates and registers a GaugeVec.
+func NewGaugeVec(name string, help string, labelNames ...string) GaugeVec {
+	return GaugeVec{register(name, help, typeGauge, nil, labelNames)}
+}
+
+// Set sets the gauge identified by labelValues.
+func (g GaugeVec) Set(value float64, labelValues ...string) {
+	g.m.set(value, labelValues)
+}
+
+// Reset drops all time series of the gauge. It's useful for gauges whose label
+// values come and go, such as per-domain gauges.
+func (g GaugeVec) Reset() {
+	g.m.reset()
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct{ m *metric }
+
+// NewHistogramVec creates and registers a HistogramVec. buckets are upper
+// bounds and must be sorted in increasing order.
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) HistogramVec {
+	return HistogramVec{register(name, help, typeHistogram, buckets, labelNames)}
+}
+
+// Observe adds a single observation to the histogram identified by
+// labelValues.
+func (h HistogramVec) Observe(value float64, labelValues ...string) {
+	h.m.observe(value, labelValues)
+}
+
+// ObserveSince is a shortcut for observing the number of seconds elapsed since
+// start.
+func (h HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.m.observe(time.Since(start).Seconds(), labelValues)
+}
+
+// Handler returns an http.Handler that serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryLock.Lock()
+		metrics := append([]*metric(nil), registry...)
+		registryLock.Unlock()
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
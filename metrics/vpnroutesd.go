@@ -0,0 +1,42 @@
+package metrics
+
+// Metrics exported by vpnroutesd.
+var (
+	RunIterations = NewCounterVec("vpnroutesd_run_iterations_total",
+		"Number of run iterations, by stage and result of the stage.", "stage", "result")
+	RunStageDuration = NewHistogramVec("vpnroutesd_run_stage_duration_seconds",
+		"Duration of each stage in run iterations.", DefaultBuckets, "stage")
+
+	DNSQueryDuration = NewHistogramVec("vpnroutesd_dns_query_duration_seconds",
+		"Latency of DNS queries, by upstream DNS server.", DefaultBuckets, "server")
+	DNSQueryFailures = NewCounterVec("vpnroutesd_dns_query_failures_total",
+		"Number of failed DNS queries, by upstream DNS server.", "server")
+	DomainResolvedIPs = NewGaugeVec("vpnroutesd_domain_resolved_ips",
+		"Number of IPs currently remembered for a domain.", "domain")
+	RoutesDamped = NewGaugeVec("vpnroutesd_routes_damped",
+		"Number of IPs kept routed by flap damping after their domains stopped resolving to them.")
+
+	RoutesAdded = NewCounterVec("vpnroutesd_routes_added_total",
+		"Number of routes added.")
+	RoutesReplaced = NewCounterVec("vpnroutesd_routes_replaced_total",
+		"Number of existing routes changed in place.")
+	RoutesDeleted = NewCounterVec("vpnroutesd_routes_deleted_total",
+		"Number of routes deleted.")
+	RouteWriteErrors = NewCounterVec("vpnroutesd_route_write_errors_total",
+		"Number of errors writing messages to the routing socket.")
+	RouteRollbacks = NewCounterVec("vpnroutesd_route_rollbacks_total",
+		"Number of times applying routes failed and was rolled back.")
+	RouteMismatches = NewCounterVec("vpnroutesd_route_mismatches_total",
+		"Number of destinations the kernel routed through an unexpected interface after applying routes.")
+
+	HealthProbes = NewCounterVec("vpnroutesd_health_probes_total",
+		"Number of health probes sent through the VPN interface, by kind (tcp, dns or icmp) and result.", "kind", "result")
+	VPNHealthy = NewGaugeVec("vpnroutesd_vpn_healthy",
+		"1 if the last health check found the VPN working, 0 if not.")
+	GroupHealthy = NewGaugeVec("vpnroutesd_group_healthy",
+		"1 if the last health check found the interface of a route group working, 0 if not.", "group")
+
+	ConfigFetchDuration = NewHistogramVec("vpnroutesd_config_fetch_duration_seconds",
+		"Duration of fetching the config file, by source type (file, https or keybase) and result.",
+		DefaultBuckets, "source", "result")
+)
@@ -0,0 +1,77 @@
+package sys
+
+import (
+	"syscall"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/route"
+)
+
+// route.RouteMessage doesn't marshal route metrics, so they're written into
+// the marshaled rt_msghdr directly, at these offsets.
+var (
+	offsetInits = unsafe.Offsetof(syscall.RtMsghdr{}.Inits)
+	offsetLocks = unsafe.Offsetof(syscall.RtMsghdr{}.Rmx) + unsafe.Offsetof(syscall.RtMetrics{}.Locks)
+	offsetMTU   = unsafe.Offsetof(syscall.RtMsghdr{}.Rmx) + unsafe.Offsetof(syscall.RtMetrics{}.Mtu)
+)
+
+// marshalRoute marshals msg, and sets the route MTU to mtu unless it's 0.
+//
+// The MTU is also locked, which keeps path MTU discovery from changing it and
+// tells it apart from the interface MTU the kernel fills in for every route.
+func marshalRoute(msg *route.RouteMessage, mtu int) ([]byte, error) {
+	b, err := msg.Marshal()
+	if err != nil || mtu == 0 {
+		return b, err
+	}
+	*(*uint32)(unsafe.Pointer(&b[offsetInits])) |= syscall.RTV_MTU
+	*(*uint32)(unsafe.Pointer(&b[offsetLocks])) |= syscall.RTV_MTU
+	*(*uint32)(unsafe.Pointer(&b[offsetMTU])) = uint32(mtu)
+	return b, nil
+}
+
+// clearUnlockedMTUs zeroes the MTU of each route in rib, a routing table
+// dump from route.FetchRIB, unless the MTU is locked. The kernel fills in the
+// interface MTU for routes that don't set one, so only locked MTUs are ones
+// set on the route; see marshalRoute.
+func clearUnlockedMTUs(rib []byte) {
+	for len(rib) >= int(unsafe.Sizeof(syscall.RtMsghdr{})) {
+		l := int(*(*uint16)(unsafe.Pointer(&rib[0])))
+		if l < int(unsafe.Sizeof(syscall.RtMsghdr{})) || l > len(rib) {
+			return
+		}
+		if rib[2] == syscall.RTM_VERSION && *(*uint32)(unsafe.Pointer(&rib[offsetLocks]))&syscall.RTV_MTU == 0 {
+			*(*uint32)(unsafe.Pointer(&rib[offsetMTU])) = 0
+		}
+		rib = rib[l:]
+	}
+}
+
+// routeMTU returns the MTU set on rm, or 0 if none was. rm must have been
+// read with fetchAllRoutes, which clears MTUs the kernel filled in.
+func routeMTU(rm *route.RouteMessage) int {
+	for _, s := range rm.Sys() {
+		if m, ok := s.(*route.RouteMetrics); ok {
+			return m.PathMTU
+		}
+	}
+	return 0
+}
+
+// warnUnsupportedAttributes logs once if any of attrs sets an attribute macOS
+// routes don't have.
+func (r *Router) warnUnsupportedAttributes(logger *zap.Logger, attrs map[string]RouteAttributes) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state.warnedAttributes {
+		return
+	}
+	for dst, a := range attrs {
+		if a.AdvMSS > 0 || a.Metric > 0 {
+			logger.Sugar().Warnf("AdvMSS and Metric aren't supported on macOS; ignoring them for %s and any other route", dst)
+			r.state.warnedAttributes = true
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package sys
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/net/route"
+)
+
+func TestClearUnlockedMTUs(t *testing.T) {
+	marshal := func(dst byte, mtu int, locked bool) []byte {
+		b, err := marshalRoute(&route.RouteMessage{
+			Version: syscall.RTM_VERSION,
+			Type:    syscall.RTM_GET,
+			Flags:   syscall.RTF_UP | syscall.RTF_HOST | syscall.RTF_STATIC,
+			Addrs: []route.Addr{
+				syscall.RTAX_DST:     &route.Inet4Addr{IP: [4]byte{10, 0, 0, dst}},
+				syscall.RTAX_GATEWAY: &route.Inet4Addr{IP: [4]byte{10, 0, 0, 254}},
+			},
+		}, mtu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !locked {
+			// What the kernel reports for a route with only the interface
+			// MTU.
+			*(*uint32)(unsafe.Pointer(&b[offsetLocks])) &^= syscall.RTV_MTU
+		}
+		return b
+	}
+	var rib []byte
+	rib = append(rib, marshal(1, 1400, true)...)
+	rib = append(rib, marshal(2, 1500, false)...)
+	rib = append(rib, marshal(3, 0, false)...)
+
+	clearUnlockedMTUs(rib)
+	msgs, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{1400, 0, 0}
+	if len(msgs) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(msgs), len(want))
+	}
+	for i, msg := range msgs {
+		if got := routeMTU(msg.(*route.RouteMessage)); got != want[i] {
+			t.Errorf("route %d: got MTU %d, want %d", i+1, got, want[i])
+		}
+	}
+}
@@ -2,6 +2,7 @@ package sys
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os/exec"
@@ -46,8 +47,9 @@ var reUTUN = regexp.MustCompile(`^utun\d+$`)
 // var reScutilInterfaceReach = regexp.MustCompile(`\s+reach\s+: 0x(\S+)`)
 
 type ifceForAutoDetect struct {
-	ifceName string
-	isVPN    bool
+	ifceName  string
+	isVPN     bool
+	vpnServer string // empty if scutil doesn't report one
 }
 
 func findIfces(output []byte) (ifces []ifceForAutoDetect, err error) {
@@ -66,6 +68,7 @@ func findIfces(output []byte) (ifces []ifceForAutoDetect, err error) {
 
 	currentIfceName := ""
 	currentIsVPN := false
+	currentVPNServer := ""
 	for {
 		line, err := buf.ReadBytes('\n')
 		switch err {
@@ -78,34 +81,48 @@ func findIfces(output []byte) (ifces []ifceForAutoDetect, err error) {
 
 		if matches := reScutilInterfaceStart.FindSubmatch(line); len(matches) > 0 {
 			if len(currentIfceName) > 0 {
-				ifces = append(ifces, ifceForAutoDetect{currentIfceName, currentIsVPN})
+				ifces = append(ifces, ifceForAutoDetect{currentIfceName, currentIsVPN, currentVPNServer})
 				currentIfceName = ""
 				currentIsVPN = false
+				currentVPNServer = ""
 			}
 			currentIfceName = string(matches[1])
-		} else if reScutilInterfaceVPNServer.Match(line) {
+		} else if matches := reScutilInterfaceVPNServer.FindSubmatch(line); len(matches) > 0 {
 			currentIsVPN = true
+			currentVPNServer = string(matches[1])
 		} else if reScutilEnd.Match(line) {
 			break
 		}
 	}
 	if len(currentIfceName) > 0 {
-		ifces = append(ifces, ifceForAutoDetect{currentIfceName, currentIsVPN})
-		currentIfceName = ""
-		currentIsVPN = false
+		ifces = append(ifces, ifceForAutoDetect{currentIfceName, currentIsVPN, currentVPNServer})
 	}
 	return ifces, nil
 }
 
-func autoDetectIfces(logger *zap.Logger, args *ApplyRoutesArgs) error {
-	output, err := exec.Command("/usr/sbin/scutil", "--nwi").Output()
+// scutilIfces returns interfaces reported by scutil, in the order scutil
+// lists them.
+func scutilIfces(ctx context.Context) ([]ifceForAutoDetect, error) {
+	output, err := exec.CommandContext(ctx, "/usr/sbin/scutil", "--nwi").Output()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ifces, err := findIfces(output)
+	return findIfces(output)
+}
+
+func autoDetectIfces(ctx context.Context, logger *zap.Logger, args *ApplyRoutesArgs) error {
+	ifces, err := scutilIfces(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to auto detect: %v", err)
 	}
+	if len(ifces) == 1 && !ifces[0].isVPN && !reUTUN.MatchString(ifces[0].ifceName) {
+		// Only the primary interface is up; the VPN is disconnected.
+		args.Interfaces = &InterfaceNames{Primary: ifces[0].ifceName}
+		return nil
+	}
+	if len(ifces) > 2 {
+		return autoDetectMultipleIfces(logger, ifces, args)
+	}
 	if len(ifces) != 2 {
 		return fmt.Errorf("failed to auto detect: expected two interfaces but found: %#+v", ifces)
 	}
@@ -149,3 +166,29 @@ func autoDetectIfces(logger *zap.Logger, args *ApplyRoutesArgs) error {
 	}
 	return nil
 }
+
+// autoDetectMultipleIfces handles more than two interfaces, e.g. when more
+// than one VPN is connected. The primary interface is the first one that's
+// not a VPN, and the VPN interface is the first VPN, in the order scutil lists
+// them, which is the order the system prefers them in.
+func autoDetectMultipleIfces(logger *zap.Logger, ifces []ifceForAutoDetect, args *ApplyRoutesArgs) error {
+	anyVPN := false
+	for _, ifce := range ifces {
+		anyVPN = anyVPN || ifce.isVPN
+	}
+	names := &InterfaceNames{}
+	for _, ifce := range ifces {
+		isVPN := ifce.isVPN || (!anyVPN && reUTUN.MatchString(ifce.ifceName))
+		if isVPN && len(names.VPN) == 0 {
+			names.VPN = ifce.ifceName
+		} else if !isVPN && len(names.Primary) == 0 {
+			names.Primary = ifce.ifceName
+		}
+	}
+	if len(names.Primary) == 0 {
+		return fmt.Errorf("failed to auto detect: no primary interface among %#+v", ifces)
+	}
+	logger.Sugar().Debugf("auto detected %d interfaces; using primary=%s vpn=%s", len(ifces), names.Primary, names.VPN)
+	args.Interfaces = names
+	return nil
+}
@@ -0,0 +1,77 @@
+package sys
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChurnLimits guard against applying a plan that changes too many routes at
+// once, e.g. because of a bad config push or a DNS server returning garbage.
+// Zero fields aren't enforced.
+//
+// Changes are measured against the routes the last applied plan intended,
+// rather than the routing table, so routes that are only put back, e.g. on a
+// VPN interface that came back under a new name, don't count. Routes replaced
+// in place don't count either, since their destinations stay routed. A route
+// turned into a reject or pinned route, or back, counts as deleted and added.
+type ChurnLimits struct {
+	// MaxRoutes limits how many routes vpnroutesd manages in total: routes
+	// through VPN and group interfaces, reject routes and pinned routes.
+	MaxRoutes int
+	// MaxAdds and MaxDeletes limit how many routes a single ApplyRoutes call
+	// adds and deletes.
+	MaxAdds    int
+	MaxDeletes int
+	// MaxDeletePercent limits the share of current routes a single
+	// ApplyRoutes call deletes. It's only enforced once more than
+	// minDeletesForPercent routes would be deleted, so small route sets can
+	// still change freely.
+	MaxDeletePercent int
+}
+
+const minDeletesForPercent = 10
+
+// exceeded describes each limit a plan exceeds, if it adds adds routes and
+// deletes deletes of current routes.
+func (l ChurnLimits) exceeded(adds, deletes, current int) (exceeded []string) {
+	if total := current + adds - deletes; l.MaxRoutes > 0 && total > l.MaxRoutes {
+		exceeded = append(exceeded, fmt.Sprintf("%d routes would be managed, more than %d", total, l.MaxRoutes))
+	}
+	if l.MaxAdds > 0 && adds > l.MaxAdds {
+		exceeded = append(exceeded, fmt.Sprintf("%d routes would be added, more than %d", adds, l.MaxAdds))
+	}
+	if l.MaxDeletes > 0 && deletes > l.MaxDeletes {
+		exceeded = append(exceeded, fmt.Sprintf("%d routes would be deleted, more than %d", deletes, l.MaxDeletes))
+	}
+	if l.MaxDeletePercent > 0 && deletes > minDeletesForPercent && current > 0 && deletes*100 > current*l.MaxDeletePercent {
+		exceeded = append(exceeded, fmt.Sprintf("%d of %d routes would be deleted, more than %d%%", deletes, current, l.MaxDeletePercent))
+	}
+	return exceeded
+}
+
+// forTransition returns l, or no limits if policy differs from lastPolicy,
+// what it was when routes were last applied. A policy like the kill switch
+// taking effect or lifting changes routes all at once, which is what it's
+// meant to do.
+func (l ChurnLimits) forTransition(policy, lastPolicy string) ChurnLimits {
+	if policy != lastPolicy {
+		return ChurnLimits{}
+	}
+	return l
+}
+
+// ChurnLimitError is returned by ApplyRoutes when applying routes would
+// exceed ApplyRoutesArgs.Limits. The routing table is left untouched. To
+// apply the plan anyway, pass PlanID as ApplyRoutesArgs.ConfirmedPlan.
+type ChurnLimitError struct {
+	// PlanID identifies the routes the plan adds and deletes.
+	PlanID string
+	// Summary counts the changes in the plan.
+	Summary string
+	// Exceeded describes each limit exceeded.
+	Exceeded []string
+}
+
+func (e *ChurnLimitError) Error() string {
+	return fmt.Sprintf("route changes blocked: plan %s (%s) exceeds limits: %s", e.PlanID, e.Summary, strings.Join(e.Exceeded, "; "))
+}
@@ -0,0 +1,109 @@
+package sys
+
+import (
+	"fmt"
+	"net"
+)
+
+// routeKind is what a route does with its destination. A route whose kind
+// changes is deleted and added again, since RTM_CHANGE can't change flags.
+type routeKind int
+
+const (
+	// kindRouted routes its destination through a VPN or group interface,
+	// or is the default route.
+	kindRouted routeKind = iota
+	kindReject
+	kindPinned
+)
+
+func (ri *routeItem) kind() routeKind {
+	switch {
+	case ri.reject:
+		return kindReject
+	case ri.pinned:
+		return kindPinned
+	default:
+		return kindRouted
+	}
+}
+
+// routeChurn counts how a plan changes the routes vpnroutesd manages.
+type routeChurn struct {
+	adds    int
+	deletes int
+	// flips are routes whose kind changes. They're deleted and added again,
+	// so ChurnLimits count them as both.
+	flips int
+	// current is the number of routes managed before the plan.
+	current int
+}
+
+func (c routeChurn) exceeded(limits ChurnLimits) []string {
+	return limits.exceeded(c.adds+c.flips, c.deletes+c.flips, c.current)
+}
+
+func (c routeChurn) String() string {
+	return fmt.Sprintf("add %d, delete %d, delete and re-add %d of %d routes", c.adds, c.deletes, c.flips, c.current)
+}
+
+// measureChurn compares the routes intended by two plans.
+func measureChurn(last, next map[routeKey]routeKind) (c routeChurn) {
+	c.current = len(last)
+	for key, kind := range next {
+		lastKind, ok := last[key]
+		switch {
+		case !ok:
+			c.adds++
+		case kind != lastKind:
+			c.flips++
+		}
+	}
+	for key := range last {
+		if _, ok := next[key]; !ok {
+			c.deletes++
+		}
+	}
+	return c
+}
+
+// intended returns the kind of every route rd intends, including those left
+// out because their interface is absent.
+func (rd *routesDescription) intended() map[routeKey]routeKind {
+	expectedItems, _ := rd.expected()
+	intended := make(map[routeKey]routeKind, len(expectedItems)+len(rd.leftOut))
+	for key, item := range expectedItems {
+		intended[key] = item.kind()
+	}
+	for _, key := range rd.leftOut {
+		if _, ok := intended[key]; !ok {
+			intended[key] = kindRouted
+		}
+	}
+	return intended
+}
+
+// churn measures p against what the last applied plan intended, so routes
+// that only need to be added again, e.g. because the VPN reconnected on a new
+// interface, don't count. Until a plan has been applied, p is measured
+// against the routing table instead.
+func (rd *routesDescription) churn(p *routePlan) routeChurn {
+	if rd.lastIntended == nil {
+		return routeChurn{adds: len(p.adds), deletes: len(p.deletes), flips: p.flips, current: p.current}
+	}
+	return measureChurn(rd.lastIntended, rd.intended())
+}
+
+// routeKeys returns the keys of routes to ips and cidrs.
+func routeKeys(ips []ipv4Addr, cidrs []*net.IPNet) []routeKey {
+	keys := make([]routeKey, 0, len(ips)+len(cidrs))
+	for _, ip := range ips {
+		keys = append(keys, (&routeItem{dst: ip}).key())
+	}
+	for _, cidr := range cidrs {
+		item := &routeItem{dst: ipToArray(cidr.IP), netmask: &ipv4Addr{}}
+		copy(item.netmask[:], cidr.Mask)
+		keys = append(keys, item.key())
+	}
+	return keys
+}
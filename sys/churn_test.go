@@ -0,0 +1,135 @@
+package sys
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChurnLimitsExceeded(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  ChurnLimits
+		adds    int
+		deletes int
+		current int
+		want    []string
+	}{
+		{
+			name:    "no limits",
+			adds:    1000,
+			deletes: 1000,
+			current: 1000,
+		},
+		{
+			name:    "within limits",
+			limits:  ChurnLimits{MaxRoutes: 100, MaxAdds: 10, MaxDeletes: 10, MaxDeletePercent: 50},
+			adds:    10,
+			deletes: 10,
+			current: 100,
+		},
+		{
+			name:    "total counts deletes",
+			limits:  ChurnLimits{MaxRoutes: 100},
+			adds:    20,
+			deletes: 10,
+			current: 95,
+			want:    []string{"105 routes would be managed, more than 100"},
+		},
+		{
+			name:    "adds and deletes",
+			limits:  ChurnLimits{MaxAdds: 5, MaxDeletes: 5},
+			adds:    6,
+			deletes: 7,
+			current: 50,
+			want: []string{
+				"6 routes would be added, more than 5",
+				"7 routes would be deleted, more than 5",
+			},
+		},
+		{
+			name:    "percent not enforced at minDeletesForPercent deletes",
+			limits:  ChurnLimits{MaxDeletePercent: 10},
+			deletes: minDeletesForPercent,
+			current: minDeletesForPercent,
+		},
+		{
+			name:    "percent enforced above minDeletesForPercent deletes",
+			limits:  ChurnLimits{MaxDeletePercent: 10},
+			deletes: minDeletesForPercent + 1,
+			current: 100,
+			want:    []string{"11 of 100 routes would be deleted, more than 10%"},
+		},
+		{
+			name:    "percent at the limit",
+			limits:  ChurnLimits{MaxDeletePercent: 10},
+			deletes: 20,
+			current: 200,
+		},
+		{
+			name:    "percent without current routes",
+			limits:  ChurnLimits{MaxDeletePercent: 10},
+			deletes: 20,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.limits.exceeded(test.adds, test.deletes, test.current)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMeasureChurn(t *testing.T) {
+	key := func(b byte) routeKey { return routeKey{dst: ipv4Addr{10, 0, 0, b}, host: true} }
+	last := map[routeKey]routeKind{
+		key(1): kindRouted,
+		key(2): kindRouted,
+		key(3): kindRouted,
+		key(4): kindPinned,
+	}
+	next := map[routeKey]routeKind{
+		key(1): kindRouted,
+		key(2): kindReject,
+		key(4): kindPinned,
+		key(5): kindRouted,
+		key(6): kindRouted,
+	}
+	want := routeChurn{adds: 2, deletes: 1, flips: 1, current: 4}
+	if got := measureChurn(last, next); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Flips count as both added and deleted.
+	if got := want.exceeded(ChurnLimits{MaxAdds: 2, MaxDeletes: 1}); len(got) != 2 {
+		t.Errorf("got %q, want adds and deletes exceeded", got)
+	}
+}
+
+func TestChurnLimitsForTransition(t *testing.T) {
+	// The kill switch engages, and turns every VPN route into a reject route.
+	last := make(map[routeKey]routeKind)
+	next := make(map[routeKey]routeKind)
+	for b := byte(1); b <= 20; b++ {
+		key := routeKey{dst: ipv4Addr{10, 0, 0, b}, host: true}
+		last[key], next[key] = kindRouted, kindReject
+	}
+	churn := measureChurn(last, next)
+	limits := ChurnLimits{MaxAdds: 5, MaxDeletes: 5}
+	if got := churn.exceeded(limits); len(got) != 2 {
+		t.Fatalf("got %q, want adds and deletes exceeded", got)
+	}
+
+	if got := churn.exceeded(limits.forTransition("VPN", "")); len(got) > 0 {
+		t.Errorf("kill switch engaging: got %q exceeded, want none", got)
+	}
+	if got := churn.exceeded(limits.forTransition("", "VPN")); len(got) > 0 {
+		t.Errorf("kill switch releasing: got %q exceeded, want none", got)
+	}
+	// Limits are back once the kill switch stays engaged.
+	if got := limits.forTransition("VPN", "VPN"); got != limits {
+		t.Errorf("kill switch unchanged: got %+v, want %+v", got, limits)
+	}
+}
@@ -0,0 +1,123 @@
+package sys
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/route"
+)
+
+// isDefaultRoute returns true if rm is a route to 0.0.0.0/0. The kernel may
+// leave out the netmask of a default route.
+func isDefaultRoute(rm *route.RouteMessage) bool {
+	dst := addrToIP(rm.Addrs[syscall.RTAX_DST])
+	if dst == nil || *dst != ipv4Zeros {
+		return false
+	}
+	netmask := addrToIP(rm.Addrs[syscall.RTAX_NETMASK])
+	return netmask == nil || *netmask == ipv4Zeros
+}
+
+// defaultRouteGateway returns the gateway of a default route through the
+// primary interface, scoped or not, or nil if there's none via a gateway.
+// VPN clients that replace the default route usually leave the scoped one
+// alone.
+func defaultRouteGateway(logger *zap.Logger, primary ifceInfo) (*ipv4Addr, error) {
+	routeMsgs, err := fetchRoutes(logger, primary.index)
+	if err != nil {
+		return nil, err
+	}
+	for _, rm := range routeMsgs {
+		if !isDefaultRoute(rm) || rm.Flags&syscall.RTF_REJECT != 0 {
+			continue
+		}
+		if gw := addrToIP(rm.Addrs[syscall.RTAX_GATEWAY]); gw != nil {
+			return gw, nil
+		}
+	}
+	return nil, nil
+}
+
+// dhcpRouterTimeout limits how long ipconfig can take, on top of ctx.
+const dhcpRouterTimeout = 5 * time.Second
+
+// dhcpRouter returns the router DHCP handed out for the interface, or nil if
+// there's none.
+func dhcpRouter(ctx context.Context, name string) *ipv4Addr {
+	ctx, cancel := context.WithTimeout(ctx, dhcpRouterTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "/usr/sbin/ipconfig", "getoption", name, "router").Output()
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(string(bytes.TrimSpace(output))).To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	gw := ipToArray(ip)
+	return &gw
+}
+
+// gatewayKey identifies a network the primary interface is on, so a gateway
+// remembered on one network isn't used on another.
+type gatewayKey struct {
+	name   string
+	selfIP ipv4Addr
+}
+
+// discoverGateway returns the gateway the default route should go through,
+// or nil if it should go through the primary link directly, e.g. for a
+// point-to-point interface. It uses, in order: a default route through the
+// primary interface, the gateway found last time on the same network, and
+// the router DHCP handed out. The first one covers the usual case; the
+// others bring back the original default route after a VPN client has
+// replaced it.
+func (r *Router) discoverGateway(ctx context.Context, logger *zap.Logger, primary ifceInfo) (*ipv4Addr, error) {
+	key := gatewayKey{name: primary.name, selfIP: primary.selfIP}
+	gw, err := defaultRouteGateway(logger, primary)
+	if err != nil {
+		return nil, err
+	}
+	if gw == nil {
+		r.lock.Lock()
+		if remembered, ok := r.state.gateways[key]; ok {
+			gw = &remembered
+		}
+		r.lock.Unlock()
+	}
+	// ipconfig runs without holding r.lock, so a slow one only holds up this
+	// call, and not GetStatus.
+	if gw == nil {
+		if gw = dhcpRouter(ctx, primary.name); gw != nil {
+			logger.Sugar().Infof("using DHCP router %s as gateway of %s", net.IP(gw[:]), primary.name)
+		}
+	}
+	if gw != nil {
+		r.lock.Lock()
+		if r.state.gateways == nil {
+			r.state.gateways = make(map[gatewayKey]ipv4Addr)
+		}
+		r.state.gateways[key] = *gw
+		r.lock.Unlock()
+	}
+	return gw, nil
+}
+
+// defaultRouteOK returns true if rm, a default route, already goes where rd
+// wants it to.
+func (rd *routesDescription) defaultRouteOK(rm *route.RouteMessage) bool {
+	if rm.Index != rd.iiPrimary.index || rm.Flags&syscall.RTF_REJECT != 0 {
+		return false
+	}
+	if rd.primaryGateway != nil {
+		gw := addrToIP(rm.Addrs[syscall.RTAX_GATEWAY])
+		return gw != nil && *gw == *rd.primaryGateway
+	}
+	link := addrToLink(rm.Addrs[syscall.RTAX_GATEWAY])
+	return link != nil && *link == rd.iiPrimary.index
+}
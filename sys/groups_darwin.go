@@ -0,0 +1,108 @@
+package sys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// interfaceSelector picks interfaces for route groups. It runs scutil at most
+// once, and only if a group needs it.
+type interfaceSelector struct {
+	ctx     context.Context
+	logger  *zap.Logger
+	primary ifceInfo
+
+	scutilDone  bool
+	scutilIfces []ifceForAutoDetect
+	scutilErr   error
+}
+
+func (s *interfaceSelector) vpnServers() ([]ifceForAutoDetect, error) {
+	if !s.scutilDone {
+		s.scutilIfces, s.scutilErr = scutilIfces(s.ctx)
+		s.scutilDone = true
+	}
+	return s.scutilIfces, s.scutilErr
+}
+
+// usable returns the interface called name if it has an IPv4 address.
+func (s *interfaceSelector) usable(name string) (ifceInfo, error) {
+	ii, err := getIfceInfo(s.logger, name)
+	if err != nil {
+		return ifceInfo{}, err
+	}
+	if ii.selfIP == ipv4Zeros {
+		return ifceInfo{}, fmt.Errorf("interface %s has no IPv4 address", name)
+	}
+	return ii, nil
+}
+
+func (s *interfaceSelector) selectName(sel InterfaceSelector) (ifceInfo, error) {
+	switch {
+	case len(sel.Name) > 0:
+		return s.usable(sel.Name)
+	case sel.Pattern != nil:
+		ifces, err := net.Interfaces()
+		if err != nil {
+			return ifceInfo{}, err
+		}
+		var matched []ifceInfo
+		var names []string
+		for _, ifce := range ifces {
+			if !sel.Pattern.MatchString(ifce.Name) || ifce.Index == s.primary.index {
+				continue
+			}
+			if ii, err := s.usable(ifce.Name); err == nil {
+				matched = append(matched, ii)
+				names = append(names, ii.name)
+			}
+		}
+		switch len(matched) {
+		case 0:
+			return ifceInfo{}, fmt.Errorf("no interface with an IPv4 address matches %s", sel.Pattern)
+		case 1:
+			return matched[0], nil
+		default:
+			return ifceInfo{}, fmt.Errorf("%d interfaces match %s: %s", len(matched), sel.Pattern, strings.Join(names, ", "))
+		}
+	case sel.VPNServer != nil:
+		ifces, err := s.vpnServers()
+		if err != nil {
+			return ifceInfo{}, err
+		}
+		for _, ifce := range ifces {
+			if server := net.ParseIP(ifce.vpnServer); server != nil && server.Equal(sel.VPNServer) {
+				return s.usable(ifce.ifceName)
+			}
+		}
+		return ifceInfo{}, fmt.Errorf("no interface has VPN server %s", sel.VPNServer)
+	default:
+		return ifceInfo{}, errors.New("no interface selector set")
+	}
+}
+
+// selectGroups finds the interface of each group. Groups whose interface
+// can't be found, or is the primary interface, are in errs instead.
+func (s *interfaceSelector) selectGroups(groups []RouteGroup) (ifces map[string]ifceInfo, errs map[string]error) {
+	ifces = make(map[string]ifceInfo)
+	errs = make(map[string]error)
+	for _, g := range groups {
+		ii, err := s.selectName(g.Interface)
+		if err == nil && ii.index == s.primary.index {
+			err = fmt.Errorf("interface %s is the primary interface", ii.name)
+		}
+		if err != nil {
+			s.logger.Sugar().Warnf("finding interface for group %s error: %v", g.Name, err)
+			errs[g.Name] = err
+			continue
+		}
+		s.logger.Sugar().Debugf("group %s interface: %s", g.Name, ii)
+		ifces[g.Name] = ii
+	}
+	return ifces, errs
+}
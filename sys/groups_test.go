@@ -0,0 +1,60 @@
+package sys
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestAddTargetsWithoutVPN(t *testing.T) {
+	_, vpnCIDR, _ := net.ParseCIDR("10.1.0.0/16")
+	args := ApplyRoutesArgs{
+		VPNIPs:   []net.IP{net.ParseIP("10.0.0.1")},
+		VPNCIDRs: []*net.IPNet{vpnCIDR},
+		Groups: []RouteGroup{
+			{Name: "lab", IPs: []net.IP{net.ParseIP("10.2.0.1")}},
+			{Name: "office", IPs: []net.IP{net.ParseIP("10.3.0.1")}},
+		},
+	}
+	lab := ifceInfo{name: "utun7", index: 15, selfIP: ipv4Addr{10, 2, 0, 100}}
+	groupIfces := map[string]ifceInfo{"lab": lab}
+	groupErrs := map[string]error{"office": errors.New("no interface matches")}
+
+	t.Run("left out", func(t *testing.T) {
+		rd := &routesDescription{}
+		rejectIPs, rejectCIDRs, killed := rd.addTargets(zap.NewNop(), args, nil, groupIfces, groupErrs)
+		if len(rd.targets) != 1 || rd.targets[0].ii != lab || !reflect.DeepEqual(rd.targets[0].ips, []ipv4Addr{{10, 2, 0, 1}}) {
+			t.Errorf("got targets %+v, want only lab's", rd.targets)
+		}
+		wantLeftOut := append(routeKeys([]ipv4Addr{{10, 0, 0, 1}}, []*net.IPNet{vpnCIDR}), routeKeys([]ipv4Addr{{10, 3, 0, 1}}, nil)...)
+		if !reflect.DeepEqual(rd.leftOut, wantLeftOut) {
+			t.Errorf("got left out %v, want %v", rd.leftOut, wantLeftOut)
+		}
+		if len(rejectIPs) > 0 || len(rejectCIDRs) > 0 || len(killed) > 0 {
+			t.Errorf("got rejected %v %v for %v, want none", rejectIPs, rejectCIDRs, killed)
+		}
+	})
+
+	t.Run("kill switch", func(t *testing.T) {
+		rd := &routesDescription{}
+		args := args
+		args.KillSwitch = true
+		rejectIPs, rejectCIDRs, killed := rd.addTargets(zap.NewNop(), args, nil, groupIfces, groupErrs)
+		if len(rd.targets) != 1 || rd.targets[0].ii != lab {
+			t.Errorf("got targets %+v, want only lab's", rd.targets)
+		}
+		if len(rd.leftOut) > 0 {
+			t.Errorf("got left out %v, want none", rd.leftOut)
+		}
+		wantIPs := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.3.0.1")}
+		if !reflect.DeepEqual(rejectIPs, wantIPs) || !reflect.DeepEqual(rejectCIDRs, []*net.IPNet{vpnCIDR}) {
+			t.Errorf("got rejected %v %v, want %v %v", rejectIPs, rejectCIDRs, wantIPs, vpnCIDR)
+		}
+		if want := []string{"VPN", "office"}; !reflect.DeepEqual(killed, want) {
+			t.Errorf("got killed %v, want %v", killed, want)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package sys
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/songgao/vpnroutesd/atomicfile"
+)
+
+// Kinds of ownedRoute.
+const (
+	ownedTarget = ""
+	ownedReject = "reject"
+	ownedPin    = "pin"
+)
+
+// ownedRoute is a route vpnroutesd added. Routes on VPN and group interfaces
+// can't be flagged with rtfOwned, since the kernel wouldn't treat them like
+// the routes VPN clients add themselves. So they are remembered instead, to
+// be swept once their interface is no longer a target, e.g. after a VPN
+// reconnects on a new utun interface. Reject and pinned routes are flagged,
+// but other software may set the same flag, so they're remembered too, and
+// only flagged routes that are remembered are taken as vpnroutesd's own.
+type ownedRoute struct {
+	// Kind is ownedTarget, ownedReject or ownedPin.
+	Kind string `json:"kind,omitempty"`
+	// Interface and Index are the interface the route was added on. Both
+	// have to match to find the route later, since an index can be reused by
+	// another interface, and a name by another interface once the first one
+	// is gone. An Index of 0 isn't known, and only the name is matched.
+	Interface string `json:"interface"`
+	Index     int    `json:"index"`
+	// Dst is the destination in CIDR form; host routes are /32.
+	Dst string `json:"dst"`
+}
+
+// on returns true if o was added on the interface with index and name.
+func (o ownedRoute) on(index int, name string) bool {
+	if len(o.Interface) == 0 || o.Interface != name {
+		return false
+	}
+	return o.Index == 0 || o.Index == index
+}
+
+type ownedState struct {
+	Routes []ownedRoute `json:"routes"`
+}
+
+func sortOwned(routes []ownedRoute) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Kind != routes[j].Kind {
+			return routes[i].Kind < routes[j].Kind
+		}
+		if routes[i].Index != routes[j].Index {
+			return routes[i].Index < routes[j].Index
+		}
+		return routes[i].Dst < routes[j].Dst
+	})
+}
+
+// readOwned reads owned routes from path. A missing file means no route is
+// owned.
+func readOwned(path string) ([]ownedRoute, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state ownedState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state.Routes, nil
+}
+
+// writeOwned atomically replaces the owned routes stored at path.
+func writeOwned(path string, routes []ownedRoute) error {
+	data, err := json.MarshalIndent(ownedState{Routes: routes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data)
+}
@@ -0,0 +1,189 @@
+package sys
+
+import (
+	"net"
+	"syscall"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/route"
+)
+
+func (k routeKey) String() string {
+	mask := net.IPMask(k.netmask[:])
+	if k.host {
+		mask = net.CIDRMask(32, 32)
+	}
+	return (&net.IPNet{IP: net.IP(k.dst[:]), Mask: mask}).String()
+}
+
+// ownedRoutes returns the routes rd adds on its targets, along with its
+// reject and pinned routes. Self routes are left out, since they go away
+// along with their interface.
+func (rd *routesDescription) ownedRoutes() (routes []ownedRoute) {
+	expectedItems, _ := rd.expected()
+	for key, item := range expectedItems {
+		switch {
+		case item.reject:
+			routes = append(routes, ownedRoute{Kind: ownedReject, Interface: rd.iiLoopback.name, Index: rd.iiLoopback.index, Dst: key.String()})
+			continue
+		case item.pinned:
+			routes = append(routes, ownedRoute{Kind: ownedPin, Interface: rd.iiPrimary.name, Index: rd.iiPrimary.index, Dst: key.String()})
+			continue
+		case item.gatewayLink == nil || item.index == rd.iiPrimary.index:
+			continue
+		}
+		for _, t := range rd.targets {
+			if t.ii.index == item.index {
+				routes = append(routes, ownedRoute{Interface: t.ii.name, Index: t.ii.index, Dst: key.String()})
+				break
+			}
+		}
+	}
+	sortOwned(routes)
+	return routes
+}
+
+// flaggedRoutes holds the destinations of the reject and pinned routes
+// vpnroutesd owns, by kind.
+type flaggedRoutes map[string]map[string]bool
+
+func newFlaggedRoutes(owned []ownedRoute) flaggedRoutes {
+	f := flaggedRoutes{ownedReject: {}, ownedPin: {}}
+	for _, o := range owned {
+		if f[o.Kind] != nil {
+			f[o.Kind][o.Dst] = true
+		}
+	}
+	return f
+}
+
+// has returns true if rm is flagged with rtfOwned and recorded as kind.
+func (f flaggedRoutes) has(rm *route.RouteMessage, kind string) bool {
+	if rm.Flags&rtfOwned == 0 {
+		return false
+	}
+	item := routeItemFromMessage(rm)
+	return item != nil && f[kind][item.key().String()]
+}
+
+// isOwnedReject returns true if rm is a reject route installed by vpnroutesd.
+func (f flaggedRoutes) isOwnedReject(rm *route.RouteMessage) bool {
+	return rm.Flags&syscall.RTF_REJECT != 0 && f.has(rm, ownedReject)
+}
+
+// isOwnedPin returns true if rm is a pinned route installed by vpnroutesd.
+func (f flaggedRoutes) isOwnedPin(rm *route.RouteMessage) bool {
+	return rm.Flags&syscall.RTF_REJECT == 0 && f.has(rm, ownedPin)
+}
+
+// interfaceNames maps interface indexes to names.
+func interfaceNames() (map[int]string, error) {
+	ifces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string, len(ifces))
+	for _, ifce := range ifces {
+		names[ifce.Index] = ifce.Name
+	}
+	return names, nil
+}
+
+// staleRoutes returns routes in rd.owned that are still in the routing table,
+// but on an interface that is no longer a target. A route is only picked up
+// if it looks like one vpnroutesd adds, i.e. via the link of its own
+// interface, and its interface has the recorded name and index.
+func (rd *routesDescription) staleRoutes(logger *zap.Logger) (stale []*route.RouteMessage, err error) {
+	if len(rd.owned) == 0 {
+		return nil, nil
+	}
+	current := map[int]bool{
+		rd.iiPrimary.index:  true,
+		rd.iiLoopback.index: true,
+	}
+	for _, t := range rd.targets {
+		current[t.ii.index] = true
+	}
+	owned := make(map[string][]ownedRoute, len(rd.owned))
+	for _, o := range rd.owned {
+		if o.Kind == ownedTarget {
+			owned[o.Dst] = append(owned[o.Dst], o)
+		}
+	}
+	names, err := interfaceNames()
+	if err != nil {
+		return nil, err
+	}
+	routeMsgs, err := fetchAllRoutes(logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, rm := range routeMsgs {
+		if current[rm.Index] || rm.Flags&(syscall.RTF_WASCLONED|rtfOwned) != 0 {
+			continue
+		}
+		if link := addrToLink(rm.Addrs[syscall.RTAX_GATEWAY]); link == nil || *link != rm.Index {
+			continue
+		}
+		item := routeItemFromMessage(rm)
+		if item == nil {
+			continue
+		}
+		for _, o := range owned[item.key().String()] {
+			if o.on(rm.Index, names[rm.Index]) {
+				logger.Sugar().Infof("found stale route %s on [%s] index=%d", item, names[rm.Index], rm.Index)
+				stale = append(stale, rm)
+				break
+			}
+		}
+	}
+	return stale, nil
+}
+
+// loadOwned returns the routes owned by vpnroutesd, reading them from
+// StateFile the first time it's called.
+func (r *Router) loadOwned(logger *zap.Logger) []ownedRoute {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.state.ownedLoaded && len(r.opts.StateFile) > 0 {
+		owned, err := readOwned(r.opts.StateFile)
+		if err != nil {
+			logger.Sugar().Warnf("reading route state from %s error: %v", r.opts.StateFile, err)
+		}
+		r.state.owned = owned
+	}
+	r.state.ownedLoaded = true
+	return r.state.owned
+}
+
+// saveOwned records routes as owned by vpnroutesd, and writes them to
+// StateFile if they've changed.
+func (r *Router) saveOwned(logger *zap.Logger, routes []ownedRoute) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	unchanged := len(routes) == len(r.state.owned)
+	for i := 0; unchanged && i < len(routes); i++ {
+		unchanged = routes[i] == r.state.owned[i]
+	}
+	r.state.owned = routes
+	if unchanged || len(r.opts.StateFile) == 0 {
+		return
+	}
+	if err := writeOwned(r.opts.StateFile, routes); err != nil {
+		logger.Sugar().Warnf("writing route state to %s error: %v", r.opts.StateFile, err)
+	}
+}
+
+// mergeOwned returns the union of a and b, sorted.
+func mergeOwned(a []ownedRoute, b []ownedRoute) []ownedRoute {
+	seen := make(map[ownedRoute]bool, len(a)+len(b))
+	var merged []ownedRoute
+	for _, o := range append(append([]ownedRoute(nil), a...), b...) {
+		if !seen[o] {
+			seen[o] = true
+			merged = append(merged, o)
+		}
+	}
+	sortOwned(merged)
+	return merged
+}
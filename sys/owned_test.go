@@ -0,0 +1,54 @@
+package sys
+
+import "testing"
+
+func TestOwnedRouteOn(t *testing.T) {
+	tests := []struct {
+		name  string
+		owned ownedRoute
+		index int
+		ifce  string
+		want  bool
+	}{
+		{
+			name:  "same interface",
+			owned: ownedRoute{Interface: "utun6", Index: 14},
+			index: 14,
+			ifce:  "utun6",
+			want:  true,
+		},
+		{
+			name:  "index reused by another interface",
+			owned: ownedRoute{Interface: "utun6", Index: 14},
+			index: 14,
+			ifce:  "utun7",
+		},
+		{
+			name:  "name reused by another interface",
+			owned: ownedRoute{Interface: "utun6", Index: 14},
+			index: 15,
+			ifce:  "utun6",
+		},
+		{
+			name:  "index not known",
+			owned: ownedRoute{Interface: "utun6"},
+			index: 15,
+			ifce:  "utun6",
+			want:  true,
+		},
+		{
+			name:  "name not known",
+			owned: ownedRoute{Index: 14},
+			index: 14,
+			ifce:  "utun6",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.owned.on(test.index, test.ifce); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
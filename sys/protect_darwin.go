@@ -0,0 +1,108 @@
+package sys
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// protectedIP is an address that must go through the primary interface, along
+// with why.
+type protectedIP struct {
+	ip     ipv4Addr
+	reason string
+}
+
+// vpnEndpoints returns the VPN server address scutil reports for each target
+// interface. Routing it into its own tunnel would kill the tunnel.
+func (s *interfaceSelector) vpnEndpoints(targets []*routeTarget) (endpoints []protectedIP) {
+	ifces, err := s.vpnServers()
+	if err != nil {
+		s.logger.Sugar().Warnf("finding VPN servers error: %v", err)
+		return nil
+	}
+	for _, t := range targets {
+		for _, ifce := range ifces {
+			if ifce.ifceName != t.ii.name {
+				continue
+			}
+			server := net.ParseIP(ifce.vpnServer).To4()
+			if server == nil || server.IsLoopback() || server.IsUnspecified() {
+				// Some VPN clients report a local proxy, which never goes
+				// through the tunnel anyway.
+				continue
+			}
+			endpoints = append(endpoints, protectedIP{
+				ip:     ipToArray(server),
+				reason: fmt.Sprintf("VPN server of %s", t.ii.name),
+			})
+		}
+	}
+	return endpoints
+}
+
+func dropIP(ips []ipv4Addr, ip ipv4Addr) (kept []ipv4Addr, dropped bool) {
+	for _, existing := range ips {
+		if existing == ip {
+			dropped = true
+			continue
+		}
+		kept = append(kept, existing)
+	}
+	return kept, dropped
+}
+
+func coveringCIDR(cidrs []*net.IPNet, ip ipv4Addr) *net.IPNet {
+	for _, cidr := range cidrs {
+		if cidr.Contains(net.IP(ip[:])) {
+			return cidr
+		}
+	}
+	return nil
+}
+
+// protect keeps protected addresses off VPN and group interfaces. They're
+// dropped from host routes, and pinned to the primary interface with a host
+// route if a CIDR would otherwise cover them. It returns a description of
+// each address it had to do something about.
+func (rd *routesDescription) protect(logger *zap.Logger, protected []protectedIP) (actions []string) {
+	seen := make(map[ipv4Addr]bool)
+	for _, p := range protected {
+		if seen[p.ip] {
+			continue
+		}
+		seen[p.ip] = true
+
+		var done []string
+		var cidr *net.IPNet
+		for _, t := range rd.targets {
+			var dropped bool
+			if t.ips, dropped = dropIP(t.ips, p.ip); dropped {
+				done = append(done, fmt.Sprintf("excluded from %s", t.ii.name))
+			}
+			if cidr == nil {
+				cidr = coveringCIDR(t.cidrs, p.ip)
+			}
+		}
+		var dropped bool
+		if rd.rejectIPs, dropped = dropIP(rd.rejectIPs, p.ip); dropped {
+			done = append(done, "excluded from reject routes")
+		}
+		if cidr == nil {
+			cidr = coveringCIDR(rd.rejectCIDRs, p.ip)
+		}
+		if cidr != nil {
+			rd.pinned = append(rd.pinned, p.ip)
+			done = append(done, fmt.Sprintf("pinned to %s since %s covers it", rd.iiPrimary.name, cidr))
+		}
+		if len(done) == 0 {
+			continue
+		}
+		action := fmt.Sprintf("%s (%s): %s", net.IP(p.ip[:]), p.reason, strings.Join(done, ", "))
+		logger.Sugar().Warnf("protected address %s", action)
+		actions = append(actions, action)
+	}
+	return actions
+}
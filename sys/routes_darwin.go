@@ -1,13 +1,16 @@
 package sys
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"syscall"
 
+	"github.com/songgao/vpnroutesd/metrics"
 	"go.uber.org/zap"
 	"golang.org/x/net/route"
 )
@@ -20,6 +23,11 @@ type ipv4Addr [4]byte
 
 var ipv4Zeros = ipv4Addr{0, 0, 0, 0}
 
+func ipToArray(ip net.IP) (ret ipv4Addr) {
+	copy(ret[:], ip.To4())
+	return ret
+}
+
 var rtAddrNames = []string{
 	syscall.RTAX_AUTHOR:  "author",
 	syscall.RTAX_BRD:     "brd",
@@ -82,6 +90,18 @@ func (ii ifceInfo) String() string {
 	return fmt.Sprintf("[%s] index=%d ip=%s", ii.name, ii.index, net.IP(ii.selfIP[:]))
 }
 
+func (ii ifceInfo) toInterface() Interface {
+	ip := make(net.IP, 4)
+	copy(ip, ii.selfIP[:])
+	return Interface{
+		Name:  ii.name,
+		Index: ii.index,
+		IP:    ip,
+	}
+}
+
+var errIfceNotFound = errors.New("interface not found")
+
 func getIfceInfo(logger *zap.Logger, name string) (info ifceInfo, err error) {
 	b, err := route.FetchRIB(syscall.AF_INET, route.RIBTypeInterface, 0)
 	if err != nil {
@@ -114,7 +134,7 @@ loopLink:
 	}
 
 	if info.index == 0 {
-		return ifceInfo{}, errors.New("interface not found")
+		return ifceInfo{}, errIfceNotFound
 	}
 
 loopAddr:
@@ -142,11 +162,12 @@ loopAddr:
 	return info, nil
 }
 
-func fetchRoutes(logger *zap.Logger, ifceIndex int) (routes []*route.RouteMessage, err error) {
+func fetchAllRoutes(logger *zap.Logger) (routes []*route.RouteMessage, err error) {
 	b, err := route.FetchRIB(syscall.AF_INET, route.RIBTypeRoute, 0)
 	if err != nil {
 		return nil, err
 	}
+	clearUnlockedMTUs(b)
 	msgs, err := route.ParseRIB(route.RIBTypeRoute, b)
 	if err != nil {
 		return nil, err
@@ -157,6 +178,17 @@ func fetchRoutes(logger *zap.Logger, ifceIndex int) (routes []*route.RouteMessag
 			// logger.Sugar().Debugf("ignoring message that is not RouteMessage")
 			continue
 		}
+		routes = append(routes, rm)
+	}
+	return routes, nil
+}
+
+func fetchRoutes(logger *zap.Logger, ifceIndex int) (routes []*route.RouteMessage, err error) {
+	msgs, err := fetchAllRoutes(logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, rm := range msgs {
 		if rm.Index != ifceIndex {
 			// logger.Sugar().Debugf("other interface:\n%s", pretty.Sprint(rm))
 			continue
@@ -204,9 +236,24 @@ func printRoutesForDebug(logger *zap.Logger, ifceIndex int, ignoreErrs bool) {
 type routeItem struct {
 	dst         ipv4Addr
 	gatewayLink *int
-	gatewayIP   *ipv4Addr // only for LOCAL routes
+	gatewayIP   *ipv4Addr
 	netmask     *ipv4Addr
 	ifa         *ipv4Addr
+	// local is true for the route to an interface's own address. Its
+	// gatewayIP is that address, rather than a gateway to go through.
+	local bool
+	// reject is true for routes that reject packets instead of forwarding
+	// them. They are on the loopback interface.
+	reject bool
+	// pinned is true for host routes that keep a protected address, like the
+	// VPN server, on the primary interface.
+	pinned bool
+	// attrs are only set on routes through targets. Only the MTU is
+	// compared by matches, since macOS routes have no other attribute.
+	attrs RouteAttributes
+	// index is the interface the route is on. It's not compared by matches,
+	// since gatewayLink and ifa already tell interfaces apart.
+	index int
 }
 
 func (ri *routeItem) String() (ret string) {
@@ -231,13 +278,60 @@ func (ri *routeItem) String() (ret string) {
 	if ri.ifa != nil {
 		ret += fmt.Sprintf(" (%s)", net.IP((*ri.ifa)[:]).String())
 	}
+	if ri.reject {
+		ret += " reject"
+	}
+	if ri.pinned {
+		ret += " pinned"
+	}
+	if ri.attrs.MTU > 0 {
+		ret += fmt.Sprintf(" mtu %d", ri.attrs.MTU)
+	}
 	return ret
 }
 
+func addrToIP(addr route.Addr) *ipv4Addr {
+	a, ok := addr.(*route.Inet4Addr)
+	if !ok || a == nil {
+		return nil
+	}
+	ip := ipv4Addr(a.IP)
+	return &ip
+}
+
+func addrToLink(addr route.Addr) *int {
+	a, ok := addr.(*route.LinkAddr)
+	if !ok || a == nil {
+		return nil
+	}
+	index := a.Index
+	return &index
+}
+
+// routeItemFromMessage does the reverse of toRouteMessage. It returns nil if
+// routeMessage doesn't have an IPv4 destination.
+func routeItemFromMessage(routeMessage *route.RouteMessage) *routeItem {
+	dst := addrToIP(routeMessage.Addrs[syscall.RTAX_DST])
+	if dst == nil {
+		return nil
+	}
+	return &routeItem{
+		dst:         *dst,
+		gatewayLink: addrToLink(routeMessage.Addrs[syscall.RTAX_GATEWAY]),
+		gatewayIP:   addrToIP(routeMessage.Addrs[syscall.RTAX_GATEWAY]),
+		netmask:     addrToIP(routeMessage.Addrs[syscall.RTAX_NETMASK]),
+		ifa:         addrToIP(routeMessage.Addrs[syscall.RTAX_IFA]),
+		local:       routeMessage.Flags&syscall.RTF_LOCAL != 0,
+		reject:      routeMessage.Flags&syscall.RTF_REJECT != 0,
+		pinned:      routeMessage.Flags&rtfOwned != 0 && routeMessage.Flags&syscall.RTF_REJECT == 0,
+		index:       routeMessage.Index,
+	}
+}
+
 func matchIP(ip *ipv4Addr, addr route.Addr) bool {
 	a, ok := addr.(*route.Inet4Addr)
-	if ip == nil && (!ok || a == nil) {
-		return true
+	if ip == nil || !ok || a == nil {
+		return ip == nil && (!ok || a == nil)
 	}
 	return a.IP == *ip
 }
@@ -252,7 +346,8 @@ func matchLink(linkIndex *int, addr route.Addr) bool {
 
 func (ri *routeItem) matches(logger *zap.Logger, routeMessage *route.RouteMessage) bool {
 	// NOTE: It seems AF_ROUTE reports error even when it works. So ignore this
-	// check for now.
+	// check for now. Whether routes actually work is checked separately by
+	// verifyEgress.
 	// if routeMessage.Err != nil {
 	// 	logger.Sugar().Debugf("routeMessage not matched: error: %v", routeMessage.Err)
 	// 	return false
@@ -277,6 +372,18 @@ func (ri *routeItem) matches(logger *zap.Logger, routeMessage *route.RouteMessag
 		logger.Sugar().Debugf("routeMessage not matched: ifa")
 		return false
 	}
+	if (routeMessage.Flags&syscall.RTF_REJECT != 0) != ri.reject {
+		logger.Sugar().Debugf("routeMessage not matched: reject")
+		return false
+	}
+	if (routeMessage.Flags&rtfOwned != 0) != ri.owned() {
+		logger.Sugar().Debugf("routeMessage not matched: owned")
+		return false
+	}
+	if routeMTU(routeMessage) != ri.attrs.MTU {
+		logger.Sugar().Debugf("routeMessage not matched: mtu")
+		return false
+	}
 	return true
 }
 
@@ -296,9 +403,17 @@ func toRouteAddr(ip *ipv4Addr, linkIndex *int) route.Addr {
 
 func (ri *routeItem) toRouteMessage(seq int, ifceIndex int, msgType int) *route.RouteMessage {
 	var flags int = syscall.RTF_UP
-	if ri.gatewayIP != nil && ri.gatewayLink == nil {
+	switch {
+	case ri.reject:
+		flags |= syscall.RTF_REJECT | syscall.RTF_STATIC | rtfOwned
+	case ri.pinned:
+		flags |= syscall.RTF_STATIC | rtfOwned
+	case ri.local:
 		flags |= syscall.RTF_LOCAL
 	}
+	if ri.gatewayIP != nil && !ri.local && !ri.reject {
+		flags |= syscall.RTF_GATEWAY
+	}
 	if ri.netmask == nil {
 		flags |= syscall.RTF_HOST
 	}
@@ -318,167 +433,759 @@ func (ri *routeItem) toRouteMessage(seq int, ifceIndex int, msgType int) *route.
 	}
 }
 
+// routeKey identifies a route by its destination. Host routes have a zero
+// netmask.
+type routeKey struct {
+	dst     ipv4Addr
+	netmask ipv4Addr
+	host    bool
+}
+
+var ipv4Ones = ipv4Addr{255, 255, 255, 255}
+
+func (ri *routeItem) key() routeKey {
+	if ri.netmask == nil || *ri.netmask == ipv4Ones {
+		return routeKey{dst: ri.dst, host: true}
+	}
+	return routeKey{dst: ri.dst, netmask: *ri.netmask}
+}
+
+// rtfOwned marks reject and pinned routes installed by vpnroutesd, so they can
+// be told apart from routes on the same interfaces added by anything else.
+// Other software may set it too, so a flagged route is only taken as
+// vpnroutesd's own if it's also recorded as owned; see ownedRoute.
+const rtfOwned = syscall.RTF_PROTO1
+
+// owned returns true if the route is marked with rtfOwned.
+func (ri *routeItem) owned() bool {
+	return ri.reject || ri.pinned
+}
+
+var ipv4Loopback = ipv4Addr{127, 0, 0, 1}
+
+// routeTarget is an interface other than the primary one, along with the
+// destinations routed through it.
+type routeTarget struct {
+	ii    ifceInfo
+	ips   []ipv4Addr
+	cidrs []*net.IPNet
+}
+
 type routesDescription struct {
-	iiPrimary ifceInfo
-	iiVPN     ifceInfo
-	vpnIPs    []ipv4Addr
+	iiPrimary  ifceInfo
+	iiLoopback ifceInfo
+	// targets are the VPN interface, unless it's absent, and interfaces of
+	// route groups. Each interface is only listed once.
+	targets []*routeTarget
+
+	rejectIPs   []ipv4Addr
+	rejectCIDRs []*net.IPNet
+
+	// pinned are protected addresses that go through the primary interface,
+	// via primaryGateway if it's not nil. So does the default route, unless
+	// unmanagedDefault is set.
+	pinned           []ipv4Addr
+	primaryGateway   *ipv4Addr
+	unmanagedDefault bool
+
+	// attrs maps destinations of routes through targets, in CIDR form, to
+	// their attributes.
+	attrs map[string]RouteAttributes
+
+	limits        ChurnLimits
+	confirmedPlan string
+	// lastIntended is what the last applied plan intended, or nil if none
+	// has been applied yet. Churn is measured against it.
+	lastIntended map[routeKey]routeKind
+	// leftOut are destinations of targets whose interface is absent. They
+	// count as routed when measuring churn, so an interface going away and
+	// coming back doesn't.
+	leftOut []routeKey
+
+	// owned are routes vpnroutesd has added on targets before. Those found
+	// on interfaces that are no longer targets are deleted.
+	owned []ownedRoute
 }
 
-func (rd *routesDescription) apply(logger *zap.Logger) (changed bool, err error) {
-	expectedItems := map[ipv4Addr]*routeItem{
-		rd.iiVPN.selfIP: {
-			dst:       rd.iiVPN.selfIP,
-			gatewayIP: &rd.iiVPN.selfIP,
-			ifa:       &rd.iiVPN.selfIP,
-		},
-		ipv4Zeros: {
-			dst:         ipv4Zeros,
-			netmask:     &ipv4Addr{0, 0, 0, 0},
-			gatewayLink: &rd.iiPrimary.index,
-			ifa:         &rd.iiPrimary.selfIP,
-		},
+// addTarget adds ips and cidrs to be routed through ii, merging them with an
+// existing target for the same interface.
+func (rd *routesDescription) addTarget(ii ifceInfo, ips []ipv4Addr, cidrs []*net.IPNet) {
+	for _, t := range rd.targets {
+		if t.ii.index == ii.index {
+			t.ips = append(t.ips, ips...)
+			t.cidrs = append(t.cidrs, cidrs...)
+			return
+		}
+	}
+	rd.targets = append(rd.targets, &routeTarget{ii: ii, ips: ips, cidrs: cidrs})
+}
+
+// expected returns the routes that should exist, keyed by routeKey, along
+// with the default route among them, which is nil if it's unmanaged.
+func (rd *routesDescription) expected() (expectedItems map[routeKey]*routeItem, defaultRoute *routeItem) {
+	expectedItems = make(map[routeKey]*routeItem)
+	if !rd.unmanagedDefault {
+		defaultRoute = &routeItem{
+			dst:     ipv4Zeros,
+			netmask: &ipv4Addr{0, 0, 0, 0},
+			ifa:     &rd.iiPrimary.selfIP,
+			index:   rd.iiPrimary.index,
+		}
+		if rd.primaryGateway != nil {
+			defaultRoute.gatewayIP = rd.primaryGateway
+		} else {
+			defaultRoute.gatewayLink = &rd.iiPrimary.index
+		}
+		expectedItems[defaultRoute.key()] = defaultRoute
+	}
+	for _, t := range rd.targets {
+		t := t
+		item := &routeItem{
+			dst:       t.ii.selfIP,
+			gatewayIP: &t.ii.selfIP,
+			ifa:       &t.ii.selfIP,
+			local:     true,
+			index:     t.ii.index,
+		}
+		expectedItems[item.key()] = item
+		for _, ip := range t.ips {
+			item := &routeItem{
+				dst:         ip,
+				gatewayLink: &t.ii.index,
+				ifa:         &t.ii.selfIP,
+				index:       t.ii.index,
+			}
+			item.attrs = rd.attrs[item.key().String()]
+			expectedItems[item.key()] = item
+		}
+		for _, cidr := range t.cidrs {
+			item := &routeItem{
+				dst:         ipToArray(cidr.IP),
+				netmask:     &ipv4Addr{},
+				gatewayLink: &t.ii.index,
+				ifa:         &t.ii.selfIP,
+				index:       t.ii.index,
+			}
+			copy(item.netmask[:], cidr.Mask)
+			item.attrs = rd.attrs[item.key().String()]
+			expectedItems[item.key()] = item
+		}
+	}
+	for _, ip := range rd.pinned {
+		item := &routeItem{
+			dst:    ip,
+			ifa:    &rd.iiPrimary.selfIP,
+			pinned: true,
+			index:  rd.iiPrimary.index,
+		}
+		if rd.primaryGateway != nil {
+			item.gatewayIP = rd.primaryGateway
+		} else {
+			item.gatewayLink = &rd.iiPrimary.index
+		}
+		expectedItems[item.key()] = item
+	}
+	for _, ip := range rd.rejectIPs {
+		item := &routeItem{
+			dst:       ip,
+			gatewayIP: &ipv4Loopback,
+			ifa:       &ipv4Loopback,
+			reject:    true,
+			index:     rd.iiLoopback.index,
+		}
+		expectedItems[item.key()] = item
 	}
-	for _, ip := range rd.vpnIPs {
-		expectedItems[ip] = &routeItem{
-			dst:         ip,
-			gatewayLink: &rd.iiVPN.index,
-			ifa:         &rd.iiVPN.selfIP,
+	for _, cidr := range rd.rejectCIDRs {
+		item := &routeItem{
+			dst:       ipToArray(cidr.IP),
+			netmask:   &ipv4Addr{},
+			gatewayIP: &ipv4Loopback,
+			ifa:       &ipv4Loopback,
+			reject:    true,
+			index:     rd.iiLoopback.index,
+		}
+		copy(item.netmask[:], cidr.Mask)
+		expectedItems[item.key()] = item
+	}
+	return expectedItems, defaultRoute
+}
+
+// plan compares the routing table with what's expected, and returns the
+// operations needed to get from one to the other.
+func (rd *routesDescription) plan(logger *zap.Logger) (*routePlan, error) {
+	expectedItems, defaultRoute := rd.expected()
+	found := make(map[routeKey]bool)
+	unwanted := make(map[routeKey][]*route.RouteMessage)
+	var unwantedKeys []routeKey
+
+	// Find the unscoped default route. If it's not through the primary
+	// interface and gateway, e.g. because a VPN client has replaced it, it's
+	// changed back. Scoped default routes are the system's own for each
+	// interface, and are left alone.
+	if defaultRoute != nil {
+		routeMsgsAll, err := fetchAllRoutes(logger)
+		if err != nil {
+			return nil, err
+		}
+		for _, rm := range routeMsgsAll {
+			if !isDefaultRoute(rm) || rm.Flags&(syscall.RTF_IFSCOPE|syscall.RTF_WASCLONED) != 0 {
+				continue
+			}
+			key := defaultRoute.key()
+			if rd.defaultRouteOK(rm) && !found[key] {
+				logger.Sugar().Debugf("skipping for existing routeItem: %s", defaultRoute)
+				found[key] = true
+				continue
+			}
+			if _, ok := unwanted[key]; !ok {
+				unwantedKeys = append(unwantedKeys, key)
+			}
+			unwanted[key] = append(unwanted[key], rm)
 		}
 	}
-	found := make(map[ipv4Addr]bool)
 
-	// See if we can find the default route, and if so, mark it as found.
 	routeMsgsPrimary, err := fetchRoutes(logger, rd.iiPrimary.index)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	// Go through all routes on the VPN and group interfaces, reject routes we
+	// own on the loopback interface, pinned routes we own on the primary
+	// interface, and routes we own on interfaces that are no longer targets,
+	// and find the ones that need to go.
+	// A flagged route that isn't recorded, e.g. because the state file was
+	// lost, is adopted if it's exactly what's expected, and otherwise left
+	// alone.
+	flagged := newFlaggedRoutes(rd.owned)
+	adopt := func(rm *route.RouteMessage) {
+		if rm.Flags&rtfOwned == 0 {
+			return
+		}
+		if existing := routeItemFromMessage(rm); existing != nil {
+			if expected := expectedItems[existing.key()]; expected != nil && expected.owned() && expected.matches(logger, rm) {
+				logger.Sugar().Debugf("adopting unrecorded routeItem: %s", expected)
+				found[existing.key()] = true
+			}
+		}
 	}
+	var routeMsgsVPN []*route.RouteMessage
 	for _, rm := range routeMsgsPrimary {
-		addr, ok := rm.Addrs[syscall.RTAX_DST].(*route.Inet4Addr)
-		if !ok || addr.IP != ipv4Zeros {
-			continue
+		if flagged.isOwnedPin(rm) {
+			routeMsgsVPN = append(routeMsgsVPN, rm)
+		} else {
+			adopt(rm)
 		}
-		expected := expectedItems[ipv4Zeros]
-		if !expected.matches(logger, rm) {
-			continue
+	}
+	for _, t := range rd.targets {
+		routeMsgs, err := fetchRoutes(logger, t.ii.index)
+		if err != nil {
+			return nil, err
 		}
-		logger.Sugar().Debugf("skipping for existing routeItem: %s", expected)
-		found[ipv4Zeros] = true
-		break
+		routeMsgsVPN = append(routeMsgsVPN, routeMsgs...)
 	}
-
-	// Go through all routes on the VPN interface and make changes as needed.
-	routeMsgsVPN, err := fetchRoutes(logger, rd.iiVPN.index)
+	routeMsgsLoopback, err := fetchRoutes(logger, rd.iiLoopback.index)
+	if err != nil {
+		return nil, err
+	}
+	for _, rm := range routeMsgsLoopback {
+		if flagged.isOwnedReject(rm) {
+			routeMsgsVPN = append(routeMsgsVPN, rm)
+		} else {
+			adopt(rm)
+		}
+	}
+	stale, err := rd.staleRoutes(logger)
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("finding stale routes error: %v", err)
 	}
-	nextSeq := 1
-	var toWrite []*route.RouteMessage
+	routeMsgsVPN = append(routeMsgsVPN, stale...)
+	current := 0
 	for _, rm := range routeMsgsVPN {
 		if rm.Flags&syscall.RTF_WASCLONED != 0 {
 			// ignore cloned routes
 			continue
 		}
-		dstAddr, ok := rm.Addrs[syscall.RTAX_DST].(*route.Inet4Addr)
-		if !ok || dstAddr == nil {
+		if isDefaultRoute(rm) {
+			// handled above, or left alone if unmanaged
+			continue
+		}
+		existing := routeItemFromMessage(rm)
+		if existing == nil {
 			// ???
 			continue
 		}
+		current++
 
-		expected := expectedItems[dstAddr.IP]
-		if expected == nil || !expected.matches(logger, rm) {
-			// Construct a DELETE message and append it to toWrite.
-			td := *rm
-			td.Seq = nextSeq
-			nextSeq++
-			td.Type = syscall.RTM_DELETE
-
-			logger.Sugar().Infof("queueing DELETE (seq %d) because routeMessage doesn't match routeItem: %s", td.Seq, expected)
-			toWrite = append(toWrite, &td)
-		} else {
+		key := existing.key()
+		expected := expectedItems[key]
+		if expected != nil && expected.matches(logger, rm) {
 			// Mark it as found so we don't re-add it.
-			found[dstAddr.IP] = true
+			found[key] = true
+			continue
 		}
+		logger.Sugar().Debugf("routeMessage doesn't match routeItem: %s", expected)
+		if _, ok := unwanted[key]; !ok {
+			unwantedKeys = append(unwantedKeys, key)
+		}
+		unwanted[key] = append(unwanted[key], rm)
 	}
 
-	for dst, item := range expectedItems {
-		if found[dst] {
+	p := &routePlan{current: current}
+	for key, item := range expectedItems {
+		if found[key] {
 			logger.Sugar().Debugf("skipping for existing routeItem: %s", item)
 			continue
 		}
-		// Append a ADD message to toWrite.
-		logger.Sugar().Infof("queueing ADD (seq %d) for routeItem: %s", nextSeq, item)
-		toWrite = append(toWrite, item.toRouteMessage(nextSeq, rd.iiVPN.index, syscall.RTM_ADD))
-		nextSeq++
+		add := routeOp{
+			key:  key,
+			msg:  item.toRouteMessage(0, item.index, syscall.RTM_ADD),
+			mtu:  item.attrs.MTU,
+			undo: item.toRouteMessage(0, item.index, syscall.RTM_DELETE),
+			desc: fmt.Sprintf("ADD %s", item),
+		}
+		if rms := unwanted[key]; len(rms) > 0 {
+			unwanted[key] = rms[1:]
+			flagsDiffer := rms[0].Flags&(syscall.RTF_REJECT|rtfOwned) != add.msg.Flags&(syscall.RTF_REJECT|rtfOwned)
+			if flagsDiffer || item.attrs.MTU == 0 && routeMTU(rms[0]) != 0 {
+				// RTM_CHANGE can't set or clear flags, nor unset an MTU, so
+				// delete the existing route right before adding the new one.
+				p.readds++
+				if flagsDiffer {
+					p.flips++
+				}
+				p.changes = append(p.changes, routeOp{
+					key:     key,
+					msg:     withType(rms[0], syscall.RTM_DELETE),
+					undo:    withType(rms[0], syscall.RTM_ADD),
+					undoMTU: routeMTU(rms[0]),
+					desc:    fmt.Sprintf("DELETE %s", routeItemFromMessage(rms[0])),
+				}, add)
+				continue
+			}
+			// Replace the existing route in place rather than deleting it and
+			// adding a new one, so there's no gap in between. This matters
+			// most for the default route.
+			p.changes = append(p.changes, routeOp{
+				key:     key,
+				msg:     item.toRouteMessage(0, item.index, syscall.RTM_CHANGE),
+				mtu:     item.attrs.MTU,
+				undo:    withType(rms[0], syscall.RTM_CHANGE),
+				undoMTU: routeMTU(rms[0]),
+				desc:    fmt.Sprintf("CHANGE to %s", item),
+			})
+			continue
+		}
+		p.adds = append(p.adds, add)
 	}
+	for _, key := range unwantedKeys {
+		for _, rm := range unwanted[key] {
+			p.deletes = append(p.deletes, routeOp{
+				key:     key,
+				msg:     withType(rm, syscall.RTM_DELETE),
+				undo:    withType(rm, syscall.RTM_ADD),
+				undoMTU: routeMTU(rm),
+				desc:    fmt.Sprintf("DELETE %s", routeItemFromMessage(rm)),
+			})
+		}
+	}
+	return p, nil
+}
 
-	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, 0)
+// apply brings the routing table in line with rd as a single transaction:
+// new routes are added before old ones are deleted, the table is re-read to
+// verify every change took effect, and if anything went wrong, the changes
+// are undone.
+func (rd *routesDescription) apply(ctx context.Context, logger *zap.Logger) (result ApplyRoutesResult, err error) {
+	p, err := rd.plan(logger)
 	if err != nil {
-		return false, err
+		return ApplyRoutesResult{}, err
 	}
-	defer syscall.Close(fd)
-
-	if len(toWrite) == 0 {
+	if p.empty() {
 		logger.Sugar().Debugf("routes are correct; done!")
-		return false, nil
+		return ApplyRoutesResult{}, nil
+	}
+	p.churn = rd.churn(p)
+	if err = p.checkLimits(logger, rd.limits, rd.confirmedPlan); err != nil {
+		return ApplyRoutesResult{}, err
 	}
 
-	logger.Sugar().Infof("writing %d routeMessage items to AF_ROUTE", len(toWrite))
-	for _, msg := range toWrite {
-		// logger.Sugar().Infof("writing message: %s", pretty.Sprint(msg))
-		b, err := msg.Marshal()
-		if err != nil {
-			return false, err
-		}
-		_, err = syscall.Write(fd, b)
-		if err != nil {
-			logger.Sugar().Warnf("error writing message seq %d: %v", msg.Seq, err)
-			continue
+	// Don't start writing if we're out of time; a partially applied routing
+	// table is worse than a stale one.
+	if err = ctx.Err(); err != nil {
+		return ApplyRoutesResult{}, err
+	}
+
+	tx, err := newRouteTx(logger)
+	if err != nil {
+		return ApplyRoutesResult{}, err
+	}
+	defer tx.close()
+
+	ops := p.ops()
+	logger.Sugar().Infof("writing %d routeMessage items to AF_ROUTE", len(ops))
+	if err = tx.write(ops); err == nil {
+		err = rd.verify(logger, ops)
+	}
+	if err != nil {
+		result.WriteErrors = tx.writeErrors
+		result.RolledBack = true
+		metrics.RouteRollbacks.Inc()
+		logger.Sugar().Warnf("applying routes failed; rolling back %d changes: %v", len(tx.applied), err)
+		if rollbackErr := tx.rollback(); rollbackErr != nil {
+			return result, fmt.Errorf("%v; rolling back also failed: %v", err, rollbackErr)
 		}
+		return result, fmt.Errorf("%v; rolled back", err)
 	}
-	logger.Sugar().Infof("done writing %d routeMessage items to AF_ROUTE", len(toWrite))
+	logger.Sugar().Infof("done writing %d routeMessage items to AF_ROUTE", len(ops))
+
+	result.Added, result.Replaced, result.Deleted = len(p.adds), len(p.changes)-p.readds, len(p.deletes)
+	metrics.RoutesAdded.Add(float64(result.Added))
+	metrics.RoutesReplaced.Add(float64(result.Replaced))
+	metrics.RoutesDeleted.Add(float64(result.Deleted))
+	return result, nil
+}
 
-	return true, nil
+// verify re-reads the routing table and checks that none of the routes
+// touched by ops still needs changing.
+func (rd *routesDescription) verify(logger *zap.Logger, ops []routeOp) error {
+	p, err := rd.plan(logger)
+	if err != nil {
+		return fmt.Errorf("re-reading routes error: %v", err)
+	}
+	touched := make(map[routeKey]bool, len(ops))
+	for _, op := range ops {
+		touched[op.key] = true
+	}
+	var mismatched []string
+	for _, op := range p.ops() {
+		if touched[op.key] {
+			mismatched = append(mismatched, op.desc)
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("routes not applied as expected; still need: %s", strings.Join(mismatched, ", "))
+	}
+	return nil
 }
 
-func applyRoutes(logger *zap.Logger, args ApplyRoutesArgs) (changed bool, err error) {
+func (r *Router) detectInterfaces(ctx context.Context, logger *zap.Logger, names *InterfaceNames) (primary ifceInfo, vpn ifceInfo, err error) {
+	args := ApplyRoutesArgs{Interfaces: names}
 	if args.Interfaces == nil {
 		logger.Sugar().Debugf("using auto detect for interface names")
-		if err := autoDetectIfces(logger, &args); err != nil {
-			return false, err
+		if err := autoDetectIfces(ctx, logger, &args); err != nil {
+			return ifceInfo{}, ifceInfo{}, err
 		}
 	}
 	if args.Interfaces.Primary == args.Interfaces.VPN {
-		return false, errors.New("primary and vpn interface can't be same")
+		return ifceInfo{}, ifceInfo{}, errors.New("primary and vpn interface can't be same")
 	}
-	ifceInfoPrimary, err := getIfceInfo(logger, args.Interfaces.Primary)
+	primary, err = getIfceInfo(logger, args.Interfaces.Primary)
 	if err != nil {
-		return false, err
+		return ifceInfo{}, ifceInfo{}, err
 	}
-	logger.Sugar().Debugf("Primary Interface: %s\n", ifceInfoPrimary)
+	logger.Sugar().Debugf("Primary Interface: %s\n", primary)
 
-	ifceInfoVPN, err := getIfceInfo(logger, args.Interfaces.VPN)
+	if len(args.Interfaces.VPN) > 0 {
+		vpn, err = getIfceInfo(logger, args.Interfaces.VPN)
+	}
+	if len(args.Interfaces.VPN) == 0 || err == errIfceNotFound || (err == nil && vpn.selfIP == ipv4Zeros) {
+		logger.Sugar().Debugf("VPN Interface %q is absent", args.Interfaces.VPN)
+		r.lock.Lock()
+		r.state.lastIfces = &[2]ifceInfo{primary, {name: args.Interfaces.VPN}}
+		r.lock.Unlock()
+		return primary, ifceInfo{}, ErrVPNInterfaceNotFound
+	}
 	if err != nil {
-		return false, err
+		return ifceInfo{}, ifceInfo{}, err
 	}
-	logger.Sugar().Debugf("VPN Interface: %s\n", ifceInfoVPN)
+	logger.Sugar().Debugf("VPN Interface: %s\n", vpn)
+
+	r.lock.Lock()
+	r.state.lastIfces = &[2]ifceInfo{primary, vpn}
+	r.lock.Unlock()
+	return primary, vpn, nil
+}
 
-	vpnIPs := make([]ipv4Addr, 0, len(args.VPNIPs))
-	for _, argIP := range args.VPNIPs {
+// toIPv4Routes converts IPs and CIDRs to the forms routesDescription uses.
+func toIPv4Routes(logger *zap.Logger, argIPs []net.IP, argCIDRs []*net.IPNet) (ips []ipv4Addr, cidrs []*net.IPNet) {
+	ips = make([]ipv4Addr, 0, len(argIPs))
+	for _, argIP := range argIPs {
 		argIPv4 := argIP.To4()
-		if argIP == nil {
-			logger.Sugar().Infof("ignored non-IPv6 address: %s\n", argIP)
+		if argIPv4 == nil {
+			logger.Sugar().Infof("ignored non-IPv4 address: %s\n", argIP)
 			continue
 		}
 
 		var ip ipv4Addr
 		copy(ip[:], argIPv4[:4])
 
-		vpnIPs = append(vpnIPs, ip)
+		ips = append(ips, ip)
+	}
+
+	for _, cidr := range argCIDRs {
+		if cidr.IP.To4() == nil {
+			logger.Sugar().Infof("ignored non-IPv4 CIDR: %s\n", cidr)
+			continue
+		}
+		if ones, _ := cidr.Mask.Size(); ones == 32 {
+			// The kernel keeps /32 routes as host routes.
+			ips = append(ips, ipToArray(cidr.IP))
+			continue
+		}
+		cidrs = append(cidrs, &net.IPNet{
+			IP:   cidr.IP.To4(),
+			Mask: net.IPMask(cidr.Mask[len(cidr.Mask)-4:]),
+		})
+	}
+	return ips, cidrs
+}
+
+func (r *Router) getInterfaces(ctx context.Context, logger *zap.Logger, names *InterfaceNames) (primary Interface, vpn Interface, err error) {
+	iiPrimary, iiVPN, err := r.detectInterfaces(ctx, logger, names)
+	if err == ErrVPNInterfaceNotFound {
+		return iiPrimary.toInterface(), Interface{}, err
+	}
+	if err != nil {
+		return Interface{}, Interface{}, err
+	}
+	return iiPrimary.toInterface(), iiVPN.toInterface(), nil
+}
+
+func (r *Router) getGroupInterfaces(ctx context.Context, logger *zap.Logger, names *InterfaceNames, groups []RouteGroup) (ifces map[string]Interface, errs map[string]error, err error) {
+	iiPrimary, _, err := r.detectInterfaces(ctx, logger, names)
+	if err != nil && err != ErrVPNInterfaceNotFound {
+		return nil, nil, err
+	}
+	selector := &interfaceSelector{ctx: ctx, logger: logger, primary: iiPrimary}
+	groupIfces, errs := selector.selectGroups(groups)
+	ifces = make(map[string]Interface, len(groupIfces))
+	for name, ii := range groupIfces {
+		ifces[name] = ii.toInterface()
+	}
+	return ifces, errs, nil
+}
+
+// addTargets adds the VPN, unless vpn is nil because its interface is absent,
+// and each group whose interface was found in groupIfces as targets of rd.
+// Destinations of absent interfaces are left out, or with the kill switch,
+// returned along with args.RejectIPs and args.RejectCIDRs to be rejected. The
+// groups, or "VPN", whose destinations the kill switch rejects are returned
+// in killed, sorted.
+func (rd *routesDescription) addTargets(logger *zap.Logger, args ApplyRoutesArgs, vpn *ifceInfo, groupIfces map[string]ifceInfo, groupErrs map[string]error) (rejectIPs []net.IP, rejectCIDRs []*net.IPNet, killed []string) {
+	rejectIPs = append([]net.IP(nil), args.RejectIPs...)
+	rejectCIDRs = append([]*net.IPNet(nil), args.RejectCIDRs...)
+	switch {
+	case vpn == nil && args.KillSwitch:
+		logger.Sugar().Warnf("VPN interface is absent; rejecting VPN destinations")
+		rejectIPs = append(rejectIPs, args.VPNIPs...)
+		rejectCIDRs = append(rejectCIDRs, args.VPNCIDRs...)
+		killed = append(killed, "VPN")
+	case vpn == nil:
+		logger.Sugar().Warnf("VPN interface is absent; leaving out VPN destinations")
+		rd.leftOut = append(rd.leftOut, routeKeys(toIPv4Routes(logger, args.VPNIPs, args.VPNCIDRs))...)
+	default:
+		ips, cidrs := toIPv4Routes(logger, args.VPNIPs, args.VPNCIDRs)
+		rd.addTarget(*vpn, ips, cidrs)
+	}
+
+	for _, g := range args.Groups {
+		if _, ok := groupErrs[g.Name]; ok {
+			if args.KillSwitch {
+				logger.Sugar().Warnf("interface for group %s is absent; rejecting its destinations", g.Name)
+				rejectIPs = append(rejectIPs, g.IPs...)
+				rejectCIDRs = append(rejectCIDRs, g.CIDRs...)
+				killed = append(killed, g.Name)
+			} else {
+				rd.leftOut = append(rd.leftOut, routeKeys(toIPv4Routes(logger, g.IPs, g.CIDRs))...)
+			}
+			continue
+		}
+		ips, cidrs := toIPv4Routes(logger, g.IPs, g.CIDRs)
+		rd.addTarget(groupIfces[g.Name], ips, cidrs)
+	}
+	sort.Strings(killed)
+	return rejectIPs, rejectCIDRs, killed
+}
+
+func (r *Router) applyRoutes(ctx context.Context, logger *zap.Logger, args ApplyRoutesArgs) (result ApplyRoutesResult, err error) {
+	ifceInfoPrimary, ifceInfoVPN, err := r.detectInterfaces(ctx, logger, args.Interfaces)
+	vpnAbsent := err == ErrVPNInterfaceNotFound
+	if err != nil && !vpnAbsent {
+		return ApplyRoutesResult{}, err
+	}
+	killSwitch := vpnAbsent && args.KillSwitch
+	ifceInfoLoopback, err := getIfceInfo(logger, "lo0")
+	if err != nil {
+		return ApplyRoutesResult{}, fmt.Errorf("finding loopback interface error: %v", err)
+	}
+
+	rd := &routesDescription{
+		iiPrimary:     ifceInfoPrimary,
+		iiLoopback:    ifceInfoLoopback,
+		attrs:         args.Attributes,
+		limits:        args.Limits,
+		confirmedPlan: args.ConfirmedPlan,
+	}
+	r.warnUnsupportedAttributes(logger, args.Attributes)
+
+	selector := &interfaceSelector{ctx: ctx, logger: logger, primary: ifceInfoPrimary}
+	groupIfces, groupErrs := selector.selectGroups(args.Groups)
+	var vpn *ifceInfo
+	if !vpnAbsent {
+		vpn = &ifceInfoVPN
+	}
+	rejectIPs, rejectCIDRs, killed := rd.addTargets(logger, args, vpn, groupIfces, groupErrs)
+	r.lock.Lock()
+	r.state.lastGroups = groupIfces
+	rd.lastIntended = r.state.intended
+	lastKilled := r.state.killed
+	r.lock.Unlock()
+	// The kill switch engaging or releasing turns routes into reject routes
+	// or back.
+	if limits := rd.limits.forTransition(strings.Join(killed, ","), lastKilled); limits != rd.limits {
+		logger.Sugar().Infof("kill switch changed for %v; not enforcing churn limits", killed)
+		rd.limits = limits
+	}
+
+	rd.rejectIPs, rd.rejectCIDRs = toIPv4Routes(logger, rejectIPs, rejectCIDRs)
+	protected := selector.vpnEndpoints(rd.targets)
+	for _, p := range args.Protected {
+		if ip4 := p.IP.To4(); ip4 != nil {
+			protected = append(protected, protectedIP{ip: ipToArray(ip4), reason: p.Reason})
+		}
+	}
+	if rd.primaryGateway, err = r.discoverGateway(ctx, logger, ifceInfoPrimary); err != nil {
+		return ApplyRoutesResult{}, fmt.Errorf("finding primary gateway error: %v", err)
+	}
+	rd.unmanagedDefault = args.UnmanagedDefaultRoute
+	protections := rd.protect(logger, protected)
+	rd.owned = r.loadOwned(logger)
+
+	result, err = rd.apply(ctx, logger)
+	if err == nil {
+		r.saveOwned(logger, rd.ownedRoutes())
+		intended := rd.intended()
+		r.lock.Lock()
+		r.state.intended = intended
+		r.state.killed = strings.Join(killed, ",")
+		r.lock.Unlock()
+	} else {
+		// Some routes may have been added and not rolled back, so keep
+		// owning both the old and the new ones.
+		r.saveOwned(logger, mergeOwned(rd.owned, rd.ownedRoutes()))
+	}
+	result.KillSwitch = killSwitch
+	result.Protections = protections
+	if rd.primaryGateway != nil && !rd.unmanagedDefault {
+		result.DefaultGateway = net.IP(append([]byte(nil), rd.primaryGateway[:]...))
+	}
+	if len(groupErrs) > 0 {
+		result.GroupErrors = groupErrs
+	}
+	if vpnAbsent && !killSwitch {
+		result.VPNErr = ErrVPNInterfaceNotFound
+	}
+	if err != nil {
+		return result, err
+	}
+	if err = rd.verifyEgress(logger); err != nil {
+		if verr, ok := err.(*VerificationError); ok {
+			metrics.RouteMismatches.Add(float64(len(verr.Mismatches)))
+		}
+		logger.Sugar().Warnf("route verification failed: %v", err)
+		return result, err
+	}
+	return result, nil
+}
+
+// routerState is the darwin specific part of Router, guarded by Router.lock.
+type routerState struct {
+	// lastIfces holds the primary and VPN interface used by the last
+	// applyRoutes call.
+	lastIfces *[2]ifceInfo
+	// lastGroups holds the interface of each route group found by the last
+	// applyRoutes call.
+	lastGroups map[string]ifceInfo
+	// gateways remembers the gateway found for the primary interface on each
+	// network, in case the default route through it goes away.
+	gateways map[gatewayKey]ipv4Addr
+	// warnedAttributes is set once unsupported route attributes have been
+	// warned about.
+	warnedAttributes bool
+	// owned are the routes vpnroutesd has added on VPN and group interfaces.
+	// They're read from RouterOptions.StateFile on first use.
+	owned       []ownedRoute
+	ownedLoaded bool
+	// intended is what the last applied plan intended, and killed are the
+	// groups, or "VPN", whose destinations the kill switch rejected then.
+	intended map[routeKey]routeKind
+	killed   string
+}
+
+func (r *Router) getStatus(logger *zap.Logger) (status Status, err error) {
+	r.lock.Lock()
+	ifces := r.state.lastIfces
+	groups := r.state.lastGroups
+	r.lock.Unlock()
+	if ifces == nil {
+		return Status{}, errors.New("interfaces not detected yet")
 	}
+	status.Primary = ifces[0].toInterface()
+	status.VPN = ifces[1].toInterface()
 
-	return (&routesDescription{
-		iiPrimary: ifceInfoPrimary,
-		iiVPN:     ifceInfoVPN,
-		vpnIPs:    vpnIPs,
-	}).apply(logger)
+	var indexes []int
+	if ifces[1].index != 0 {
+		indexes = append(indexes, ifces[1].index)
+	}
+	if len(groups) > 0 {
+		status.Groups = make(map[string]Interface, len(groups))
+	}
+	for name, ii := range groups {
+		status.Groups[name] = ii.toInterface()
+		indexes = append(indexes, ii.index)
+	}
+	sort.Ints(indexes)
+	var routeMsgs []*route.RouteMessage
+	for i, index := range indexes {
+		if i > 0 && indexes[i-1] == index {
+			continue
+		}
+		msgs, err := fetchRoutes(logger, index)
+		if err != nil {
+			return Status{}, err
+		}
+		routeMsgs = append(routeMsgs, msgs...)
+	}
+	loopback, err := getIfceInfo(logger, "lo0")
+	if err != nil {
+		return Status{}, err
+	}
+	loopbackMsgs, err := fetchRoutes(logger, loopback.index)
+	if err != nil {
+		return Status{}, err
+	}
+	flagged := newFlaggedRoutes(r.loadOwned(logger))
+	for _, rm := range loopbackMsgs {
+		if flagged.isOwnedReject(rm) {
+			routeMsgs = append(routeMsgs, rm)
+		}
+	}
+	primaryMsgs, err := fetchRoutes(logger, ifces[0].index)
+	if err != nil {
+		return Status{}, err
+	}
+	for _, rm := range primaryMsgs {
+		if flagged.isOwnedPin(rm) {
+			routeMsgs = append(routeMsgs, rm)
+		}
+	}
+	for _, rm := range routeMsgs {
+		if rm.Flags&syscall.RTF_WASCLONED != 0 {
+			continue
+		}
+		if item := routeItemFromMessage(rm); item != nil {
+			status.Routes = append(status.Routes, item.String())
+		}
+	}
+	return status, nil
 }
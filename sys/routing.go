@@ -1,7 +1,13 @@
 package sys
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"regexp"
+	"strings"
+	"sync"
 
 	"go.uber.org/zap"
 )
@@ -12,6 +18,47 @@ type InterfaceNames struct {
 	VPN     string
 }
 
+// InterfaceSelector picks the interface a RouteGroup goes through. Exactly one
+// field is set.
+type InterfaceSelector struct {
+	// Name is the exact interface name.
+	Name string
+	// Pattern must match exactly one interface name, among interfaces that
+	// have an IPv4 address and aren't the primary interface.
+	Pattern *regexp.Regexp
+	// VPNServer picks the VPN interface whose VPN server address, as reported
+	// by the system, is VPNServer.
+	VPNServer net.IP
+}
+
+// RouteGroup is a set of destinations routed through an interface picked by
+// Interface, rather than the VPN interface.
+type RouteGroup struct {
+	Name      string
+	Interface InterfaceSelector
+	IPs       []net.IP
+	CIDRs     []*net.IPNet
+}
+
+// RouteAttributes are optional attributes of a route. Zero fields are not
+// set.
+type RouteAttributes struct {
+	// MTU is the maximum packet size sent over the route.
+	MTU int
+	// AdvMSS is the TCP maximum segment size advertised over the route.
+	// Linux only.
+	AdvMSS int
+	// Metric is the route metric, or priority. Linux only.
+	Metric int
+}
+
+// ProtectedIP is an address that must go through the primary interface.
+type ProtectedIP struct {
+	IP net.IP
+	// Reason is what the address is, e.g. "DNS server", for logs.
+	Reason string
+}
+
 // ApplyRoutesArgs includes args needed to call ApplyRoutes. These arges
 // specifies the desired final state that ApplyRoutes should achieve.
 type ApplyRoutesArgs struct {
@@ -20,12 +67,185 @@ type ApplyRoutesArgs struct {
 	Interfaces *InterfaceNames
 	// VPNIPs is a list of IPs that should go through the VPN interface.
 	VPNIPs []net.IP
+	// VPNCIDRs is a list of networks that should go through the VPN interface.
+	VPNCIDRs []*net.IPNet
+	// RejectIPs and RejectCIDRs are destinations that should be unreachable,
+	// rather than go through either interface. They must not overlap with
+	// VPNIPs and VPNCIDRs.
+	RejectIPs   []net.IP
+	RejectCIDRs []*net.IPNet
+	// Protected must go through the primary interface, e.g. DNS servers
+	// vpnroutesd talks to directly. They're left out of VPN and group routes,
+	// and pinned to the primary interface if a CIDR covers them. The VPN
+	// server of each VPN and group interface is always protected.
+	Protected []ProtectedIP
+	// Groups are routed through their own interfaces. Destinations must not
+	// overlap between groups, or with VPNIPs and VPNCIDRs.
+	Groups []RouteGroup
+	// KillSwitch makes ApplyRoutes install reject routes for VPNIPs and
+	// VPNCIDRs when the VPN interface is absent, rather than leave them out.
+	// They are swapped back to VPN routes once the interface is back. The
+	// same goes for each group whose interface can't be found.
+	KillSwitch bool
+	// Attributes maps destinations of VPN and group routes, in CIDR form
+	// with host routes as /32, to attributes of their routes. A route whose
+	// attributes differ is changed.
+	Attributes map[string]RouteAttributes
+	// Limits blocks plans that change too many routes at once, unless
+	// ConfirmedPlan is the ID of the plan. See ChurnLimitError.
+	Limits        ChurnLimits
+	ConfirmedPlan string
+	// UnmanagedDefaultRoute leaves the default route alone. Otherwise, it's
+	// kept going through the primary interface, via its gateway, and put
+	// back there if a VPN client replaces it.
+	UnmanagedDefaultRoute bool
+}
+
+// ErrVPNInterfaceNotFound is returned when the VPN interface doesn't exist, or
+// has no IPv4 address, e.g. because the VPN is disconnected.
+var ErrVPNInterfaceNotFound = errors.New("VPN interface not found")
+
+// ApplyRoutesResult describes what an ApplyRoutes call has changed.
+type ApplyRoutesResult struct {
+	// Added is the number of routes added.
+	Added int
+	// Replaced is the number of existing routes changed in place.
+	Replaced int
+	// Deleted is the number of routes deleted.
+	Deleted int
+	// WriteErrors is the number of route messages that failed to be written.
+	WriteErrors int
+	// RolledBack is true if applying routes failed part way, and the routes
+	// already changed were restored. Added, Replaced and Deleted are zero in
+	// that case.
+	RolledBack bool
+	// KillSwitch is true if the VPN interface is absent, and VPN destinations
+	// were rejected instead because ApplyRoutesArgs.KillSwitch is set.
+	KillSwitch bool
+	// GroupErrors maps groups whose interface couldn't be found to why. Their
+	// destinations are left out, or rejected if ApplyRoutesArgs.KillSwitch is
+	// set. Routes for other groups are still applied.
+	GroupErrors map[string]error
+	// VPNErr is ErrVPNInterfaceNotFound if the VPN interface is absent and
+	// ApplyRoutesArgs.KillSwitch isn't set. Like a group's, VPN destinations
+	// are left out then, and routes for groups are still applied.
+	VPNErr error
+	// Protections describes each protected address that had to be left out
+	// of VPN routes or pinned to the primary interface.
+	Protections []string
+	// DefaultGateway is the gateway the default route goes through, or nil
+	// if it goes through the primary link directly or is unmanaged.
+	DefaultGateway net.IP
+}
+
+// Changed returns true if any routes were added, replaced or deleted.
+func (r ApplyRoutesResult) Changed() bool {
+	return r.Added > 0 || r.Replaced > 0 || r.Deleted > 0
+}
+
+// RouteMismatch is a destination the kernel routes through an unexpected
+// interface.
+type RouteMismatch struct {
+	Dst net.IP
+	// Want and Got are interface names. Got describes the error instead if
+	// the kernel couldn't be asked.
+	Want string
+	Got  string
+}
+
+func (m RouteMismatch) String() string {
+	return fmt.Sprintf("%s: want %s, got %s", m.Dst, m.Want, m.Got)
+}
+
+// VerificationError is returned by ApplyRoutes when routes have been applied,
+// but the kernel doesn't route some destinations through the interface they
+// should go through.
+type VerificationError struct {
+	Mismatches []RouteMismatch
+}
+
+func (e *VerificationError) Error() string {
+	msgs := make([]string, 0, len(e.Mismatches))
+	for _, m := range e.Mismatches {
+		msgs = append(msgs, m.String())
+	}
+	return fmt.Sprintf("kernel routes %d destinations unexpectedly: %s", len(e.Mismatches), strings.Join(msgs, "; "))
+}
+
+// RouterOptions configures a Router.
+type RouterOptions struct {
+	// StateFile, if not empty, is where the routes added by the Router are
+	// recorded, so they can still be cleaned up after a restart if their
+	// interface is no longer the VPN or a group interface.
+	StateFile string
+}
+
+// Router manages the system routing table. It remembers the interfaces used
+// by the last ApplyRoutes call, for GetStatus, and the routes it has added,
+// so they can be removed once their interface is no longer used.
+type Router struct {
+	opts  RouterOptions
+	lock  sync.Mutex
+	state routerState
+}
+
+// NewRouter creates a Router.
+func NewRouter(opts RouterOptions) *Router {
+	return &Router{opts: opts}
 }
 
 // ApplyRoutes takes a declarative speficiation of what the routes should be
-// like, and interact with the system routing table to achieve that state.
-func ApplyRoutes(logger *zap.Logger, args ApplyRoutesArgs) (changed bool, err error) {
+// like, and interact with the system routing table to achieve that state. If
+// ctx is done before any route is written, it returns ctx.Err() without
+// touching the routing table.
+//
+// Changes are applied as a transaction: if any of them fails, or the routing
+// table doesn't look as expected afterwards, the routes already changed are
+// restored and an error is returned.
+//
+// Afterwards, the kernel is asked how it'd route each VPN destination and a
+// few others. If any goes through the wrong interface, a *VerificationError
+// is returned along with the result.
+func (r *Router) ApplyRoutes(ctx context.Context, logger *zap.Logger, args ApplyRoutesArgs) (result ApplyRoutesResult, err error) {
 	logger.Sugar().Debugf("+ ApplyRoutes")
 	defer logger.Sugar().Debugf("- ApplyRoutes")
-	return applyRoutes(logger, args)
+	return r.applyRoutes(ctx, logger, args)
+}
+
+// DetectInterfaces returns the primary and VPN interfaces named by names, or
+// auto detects them if names is nil. If only the primary interface is found,
+// err is ErrVPNInterfaceNotFound.
+func (r *Router) DetectInterfaces(ctx context.Context, logger *zap.Logger, names *InterfaceNames) (primary Interface, vpn Interface, err error) {
+	return r.getInterfaces(ctx, logger, names)
+}
+
+// DetectGroupInterfaces returns the interface of each group found the way
+// ApplyRoutes finds it, and maps groups whose interface can't be found to
+// why. err is set if the primary interface can't be found.
+func (r *Router) DetectGroupInterfaces(ctx context.Context, logger *zap.Logger, names *InterfaceNames, groups []RouteGroup) (ifces map[string]Interface, errs map[string]error, err error) {
+	return r.getGroupInterfaces(ctx, logger, names, groups)
+}
+
+// Interface describes a network interface that routes are applied to.
+type Interface struct {
+	Name  string
+	Index int
+	IP    net.IP
+}
+
+// Status describes the interfaces used by the last ApplyRoutes call, and the
+// routes currently installed on the VPN and group interfaces, along with
+// reject and pinned routes vpnroutesd owns.
+type Status struct {
+	Primary Interface
+	VPN     Interface
+	// Groups maps route groups to the interface they went through.
+	Groups map[string]Interface
+	Routes []string
+}
+
+// GetStatus returns the current Status. It returns an error if ApplyRoutes
+// hasn't got as far as detecting interfaces yet.
+func (r *Router) GetStatus(logger *zap.Logger) (Status, error) {
+	return r.getStatus(logger)
 }
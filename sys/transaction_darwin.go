@@ -0,0 +1,174 @@
+package sys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/songgao/vpnroutesd/metrics"
+	"go.uber.org/zap"
+	"golang.org/x/net/route"
+)
+
+// routeOp is a single message to write to the routing socket, along with the
+// message that undoes it. mtu and undoMTU are the route MTU to set with each,
+// if not 0.
+type routeOp struct {
+	key     routeKey
+	msg     *route.RouteMessage
+	mtu     int
+	undo    *route.RouteMessage
+	undoMTU int
+	desc    string
+}
+
+// routePlan holds the operations needed to bring the routing table in line.
+type routePlan struct {
+	adds    []routeOp
+	changes []routeOp
+	deletes []routeOp
+	// readds are the routes changes deletes and adds again, rather than
+	// change in place. Each of them takes two ops. flips are those among them
+	// whose kind changes.
+	readds int
+	flips  int
+	// current is the number of existing routes managed by vpnroutesd.
+	current int
+	// churn is what ChurnLimits are checked against.
+	churn routeChurn
+}
+
+func (p *routePlan) empty() bool {
+	return len(p.adds) == 0 && len(p.changes) == 0 && len(p.deletes) == 0
+}
+
+// id identifies the routes p adds, changes and deletes, so a plan blocked by
+// ChurnLimits can be confirmed.
+func (p *routePlan) id() string {
+	ops := p.ops()
+	descs := make([]string, 0, len(ops))
+	for _, op := range ops {
+		descs = append(descs, op.desc)
+	}
+	sort.Strings(descs)
+	sum := sha256.Sum256([]byte(strings.Join(descs, "\n")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// maxLoggedOps is how many ops of a blocked plan are logged, of each kind.
+const maxLoggedOps = 10
+
+// checkLimits returns a *ChurnLimitError if p exceeds limits and isn't
+// confirmed, and logs what p would have done.
+func (p *routePlan) checkLimits(logger *zap.Logger, limits ChurnLimits, confirmed string) error {
+	exceeded := p.churn.exceeded(limits)
+	if len(exceeded) == 0 {
+		return nil
+	}
+	err := &ChurnLimitError{PlanID: p.id(), Summary: p.churn.String(), Exceeded: exceeded}
+	if err.PlanID == confirmed {
+		logger.Sugar().Warnf("applying confirmed plan %s (%s) despite limits: %s", err.PlanID, err.Summary, strings.Join(exceeded, "; "))
+		return nil
+	}
+	logger.Sugar().Warnf("%v", err)
+	for _, ops := range [][]routeOp{p.adds, p.changes, p.deletes} {
+		for i, op := range ops {
+			if i == maxLoggedOps {
+				logger.Sugar().Warnf("  ... and %d more", len(ops)-i)
+				break
+			}
+			logger.Sugar().Warnf("  blocked: %s", op.desc)
+		}
+	}
+	return err
+}
+
+// ops returns all operations in the order they should be applied: new routes
+// are added first, then existing ones are replaced, and only then are old ones
+// deleted. That way, traffic that should go through the VPN never falls back
+// to the primary interface in between.
+func (p *routePlan) ops() []routeOp {
+	ops := make([]routeOp, 0, len(p.adds)+len(p.changes)+len(p.deletes))
+	ops = append(ops, p.adds...)
+	ops = append(ops, p.changes...)
+	return append(ops, p.deletes...)
+}
+
+// withType returns a copy of rm with its type set to msgType.
+func withType(rm *route.RouteMessage, msgType int) *route.RouteMessage {
+	c := *rm
+	c.Type = msgType
+	c.Err = nil
+	return &c
+}
+
+// routeTx writes routeOps to the routing socket, remembering which ones have
+// been applied so they can be rolled back.
+type routeTx struct {
+	logger      *zap.Logger
+	fd          int
+	seq         int
+	applied     []routeOp
+	writeErrors int
+}
+
+func newRouteTx(logger *zap.Logger) (*routeTx, error) {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &routeTx{logger: logger, fd: fd}, nil
+}
+
+func (tx *routeTx) close() {
+	syscall.Close(tx.fd)
+}
+
+func (tx *routeTx) writeMessage(msg *route.RouteMessage, mtu int) error {
+	tx.seq++
+	msg.Seq = tx.seq
+	b, err := marshalRoute(msg, mtu)
+	if err != nil {
+		return err
+	}
+	if _, err = syscall.Write(tx.fd, b); err != nil {
+		tx.writeErrors++
+		metrics.RouteWriteErrors.Inc()
+		return err
+	}
+	return nil
+}
+
+// write applies ops in order, and stops at the first one that fails.
+func (tx *routeTx) write(ops []routeOp) error {
+	for _, op := range ops {
+		tx.logger.Sugar().Infof("writing %s (seq %d)", op.desc, tx.seq+1)
+		if err := tx.writeMessage(op.msg, op.mtu); err != nil {
+			return fmt.Errorf("writing %s error: %v", op.desc, err)
+		}
+		tx.applied = append(tx.applied, op)
+	}
+	return nil
+}
+
+// rollback undoes applied ops in reverse order. It keeps going if undoing an
+// op fails, and returns all failures.
+func (tx *routeTx) rollback() error {
+	var failures []string
+	for i := len(tx.applied) - 1; i >= 0; i-- {
+		op := tx.applied[i]
+		tx.logger.Sugar().Infof("undoing %s (seq %d)", op.desc, tx.seq+1)
+		if err := tx.writeMessage(op.undo, op.undoMTU); err != nil {
+			tx.logger.Sugar().Warnf("undoing %s error: %v", op.desc, err)
+			failures = append(failures, fmt.Sprintf("undoing %s: %v", op.desc, err))
+		}
+	}
+	tx.applied = nil
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package sys
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/route"
+)
+
+// routeGetTimeout limits how long to wait for the kernel to answer a RTM_GET.
+const routeGetTimeout = time.Second
+
+// egressSamples are well known public addresses used to check that traffic
+// not meant for the VPN still goes through the primary interface. Ones
+// covered by VPN routes are skipped.
+var egressSamples = []ipv4Addr{
+	{1, 1, 1, 1},
+	{9, 9, 9, 9},
+	{208, 67, 222, 222},
+}
+
+// routeGetter asks the kernel which route it'd use for a destination.
+type routeGetter struct {
+	fd  int
+	pid int
+	seq int
+	buf []byte
+}
+
+func newRouteGetter() (*routeGetter, error) {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	tv := syscall.NsecToTimeval(routeGetTimeout.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &routeGetter{fd: fd, pid: os.Getpid(), buf: make([]byte, os.Getpagesize())}, nil
+}
+
+func (g *routeGetter) close() {
+	syscall.Close(g.fd)
+}
+
+// egress returns the index of the interface the kernel would send packets to
+// dst through.
+func (g *routeGetter) egress(dst ipv4Addr) (int, error) {
+	g.seq++
+	msg := &route.RouteMessage{
+		Version: routeMessageVersion,
+		Type:    syscall.RTM_GET,
+		Flags:   syscall.RTF_UP | syscall.RTF_HOST,
+		ID:      uintptr(g.pid),
+		Seq:     g.seq,
+		Addrs: []route.Addr{
+			syscall.RTAX_DST: &route.Inet4Addr{IP: dst},
+			// An empty link address asks the kernel to include the interface
+			// in the reply.
+			syscall.RTAX_IFP: &route.LinkAddr{},
+		},
+	}
+	b, err := msg.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = syscall.Write(g.fd, b); err != nil {
+		return 0, err
+	}
+
+	// The routing socket also carries messages about every other change to
+	// the routing table, so skip until we get the reply to ours.
+	for {
+		n, err := syscall.Read(g.fd, g.buf)
+		if err != nil {
+			return 0, err
+		}
+		msgs, err := route.ParseRIB(route.RIBTypeRoute, g.buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			rm, ok := m.(*route.RouteMessage)
+			if !ok || rm.Type != syscall.RTM_GET || rm.ID != uintptr(g.pid) || rm.Seq != g.seq {
+				continue
+			}
+			if rm.Err != nil {
+				return 0, rm.Err
+			}
+			if rm.Index == 0 {
+				return 0, errors.New("kernel didn't report an interface")
+			}
+			return rm.Index, nil
+		}
+	}
+}
+
+func ifceName(index int) string {
+	ifce, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return fmt.Sprintf("#%d", index)
+	}
+	return ifce.Name
+}
+
+// covered returns true if ip is routed through a VPN or group interface, or
+// rejected, by rd.
+func (rd *routesDescription) covered(ip ipv4Addr) bool {
+	ipLists := [][]ipv4Addr{rd.rejectIPs}
+	cidrLists := [][]*net.IPNet{rd.rejectCIDRs}
+	for _, t := range rd.targets {
+		ipLists = append(ipLists, t.ips)
+		cidrLists = append(cidrLists, t.cidrs)
+	}
+	for _, ips := range ipLists {
+		for _, routed := range ips {
+			if routed == ip {
+				return true
+			}
+		}
+	}
+	for _, cidrs := range cidrLists {
+		for _, cidr := range cidrs {
+			if cidr.Contains(net.IP(ip[:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyEgress asks the kernel how it'd route every VPN, group and reject
+// destination, and a few destinations that are none of them if the default
+// route is managed, and returns a
+// *VerificationError if any of them goes out the wrong interface.
+func (rd *routesDescription) verifyEgress(logger *zap.Logger) error {
+	type check struct {
+		dst  ipv4Addr
+		want ifceInfo
+	}
+	var checks []check
+	for _, t := range rd.targets {
+		for _, ip := range t.ips {
+			checks = append(checks, check{ip, t.ii})
+		}
+		for _, cidr := range t.cidrs {
+			checks = append(checks, check{ipToArray(cidr.IP), t.ii})
+		}
+	}
+	for _, ip := range rd.pinned {
+		checks = append(checks, check{ip, rd.iiPrimary})
+	}
+	for _, ip := range rd.rejectIPs {
+		checks = append(checks, check{ip, rd.iiLoopback})
+	}
+	for _, cidr := range rd.rejectCIDRs {
+		checks = append(checks, check{ipToArray(cidr.IP), rd.iiLoopback})
+	}
+	for _, ip := range egressSamples {
+		// Without a managed default route, these may well go through a
+		// full tunnel VPN.
+		if !rd.unmanagedDefault && !rd.covered(ip) {
+			checks = append(checks, check{ip, rd.iiPrimary})
+		}
+	}
+
+	g, err := newRouteGetter()
+	if err != nil {
+		return fmt.Errorf("opening routing socket for verification error: %v", err)
+	}
+	defer g.close()
+
+	verr := &VerificationError{}
+	for _, c := range checks {
+		dst := net.IP(append([]byte(nil), c.dst[:]...))
+		index, err := g.egress(c.dst)
+		if err != nil {
+			verr.Mismatches = append(verr.Mismatches, RouteMismatch{
+				Dst:  dst,
+				Want: c.want.name,
+				Got:  fmt.Sprintf("error: %v", err),
+			})
+			continue
+		}
+		if index != c.want.index {
+			verr.Mismatches = append(verr.Mismatches, RouteMismatch{
+				Dst:  dst,
+				Want: c.want.name,
+				Got:  ifceName(index),
+			})
+			continue
+		}
+		logger.Sugar().Debugf("kernel routes %s through %s as expected", dst, c.want.name)
+	}
+	if len(verr.Mismatches) > 0 {
+		return verr
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package vpnroutes
+
+import (
+	"testing"
+
+	"github.com/songgao/vpnroutesd/config"
+	"github.com/songgao/vpnroutesd/sys"
+)
+
+func TestChurnLimitsOnPolicyTransition(t *testing.T) {
+	limits := sys.ChurnLimits{MaxAdds: 5, MaxDeletes: 5}
+	d := &Daemon{opts: Options{ChurnLimits: limits}}
+
+	steps := []struct {
+		name   string
+		result Result
+		want   sys.ChurnLimits
+	}{
+		{
+			name: "healthy",
+			want: limits,
+		},
+		{
+			name:   "VPN withdrawn",
+			result: Result{HealthAction: config.FailureWithdraw},
+		},
+		{
+			name:   "still withdrawn",
+			result: Result{HealthAction: config.FailureWithdraw},
+			want:   limits,
+		},
+		{
+			name: "group rejected too",
+			result: Result{
+				HealthAction:       config.FailureWithdraw,
+				GroupHealthActions: map[string]config.FailurePolicy{"lab": config.FailureReject},
+			},
+		},
+		{
+			name: "group kept",
+			result: Result{
+				HealthAction:       config.FailureWithdraw,
+				GroupHealthActions: map[string]config.FailurePolicy{"lab": config.FailureKeep},
+			},
+		},
+		{
+			name:   "still withdrawn, group kept",
+			result: Result{HealthAction: config.FailureWithdraw},
+			want:   limits,
+		},
+		{
+			name: "healthy again",
+		},
+	}
+	for _, step := range steps {
+		policies := step.result.healthPolicies()
+		if got := d.churnLimits(policies); got != step.want {
+			t.Errorf("%s: got %+v, want %+v", step.name, got, step.want)
+		}
+		d.appliedPolicies = policies
+	}
+}
@@ -0,0 +1,336 @@
+package vpnroutes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/songgao/vpnroutesd/config"
+	"github.com/songgao/vpnroutesd/sys"
+	"go.uber.org/zap"
+)
+
+const defaultOverrideTTL = time.Hour
+
+type peerCredKey struct{}
+
+type peerCredentials struct {
+	uid  uint32
+	gids []uint32
+	err  error
+}
+
+// controlServer serves a JSON over HTTP API on a Unix domain socket, so a
+// running vpnroutesd can be inspected and poked without reading debug logs.
+//
+// Only root, and members of the control group if one is configured, are
+// allowed to talk to it. This is enforced both by the permission bits on the
+// socket file and by checking peer credentials on each connection.
+type controlServer struct {
+	logger *zap.Logger
+	gid    int // -1 if no control group is configured
+	daemon *Daemon
+}
+
+func newControlServer(logger *zap.Logger, d *Daemon) *controlServer {
+	return &controlServer{
+		logger: logger,
+		gid:    -1,
+		daemon: d,
+	}
+}
+
+func (s *controlServer) listen(socketPath string, group string) (net.Listener, error) {
+	mode := os.FileMode(0600)
+	if len(group) > 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		if s.gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, err
+		}
+		mode = 0660
+	}
+
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err = os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socketPath, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if s.gid >= 0 {
+		if err = os.Chown(socketPath, 0, s.gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (s *controlServer) authorized(cred peerCredentials) bool {
+	if cred.err != nil {
+		return false
+	}
+	if cred.uid == 0 {
+		return true
+	}
+	if s.gid < 0 {
+		return false
+	}
+	for _, gid := range cred.gids {
+		if int(gid) == s.gid {
+			return true
+		}
+	}
+	return false
+}
+
+// serve serves the control API on socketPath until ctx is done, and removes
+// the socket afterwards.
+func (s *controlServer) serve(ctx context.Context, socketPath string, group string) error {
+	l, err := s.listen(socketPath, group)
+	if err != nil {
+		return err
+	}
+	s.logger.Sugar().Infof("control API listening on %s", socketPath)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", s.handleStatus)
+	mux.HandleFunc("/v1/reconcile", s.handleReconcile)
+	mux.HandleFunc("/v1/routes/confirm", s.handleConfirm)
+	mux.HandleFunc("/v1/domains/add", s.handleDomain(s.daemon.overrides.add))
+	mux.HandleFunc("/v1/domains/remove", s.handleDomain(s.daemon.overrides.remove))
+	mux.HandleFunc("/v1/domains/reset", s.handleDomain(func(domain string, _ time.Duration) {
+		s.daemon.overrides.reset(domain)
+	}))
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cred, _ := r.Context().Value(peerCredKey{}).(peerCredentials)
+			if !s.authorized(cred) {
+				s.logger.Sugar().Warnf("control API: rejecting request from uid %d: %v", cred.uid, cred.err)
+				writeJSONError(w, http.StatusForbidden, errors.New("permission denied"))
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			var cred peerCredentials
+			if uc, ok := c.(*net.UnixConn); ok {
+				cred.uid, cred.gids, cred.err = peerCred(uc)
+			} else {
+				cred.err = errors.New("not a unix socket connection")
+			}
+			return context.WithValue(ctx, peerCredKey{}, cred)
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	defer os.Remove(socketPath)
+	if err = server.Serve(l); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+type statusRecord struct {
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type statusSource struct {
+	Source       string `json:"source"`
+	Hash         string `json:"hash"`
+	SigningKeyID string `json:"signingKeyID,omitempty"`
+	Stale        bool   `json:"stale,omitempty"`
+	StaleReason  string `json:"staleReason,omitempty"`
+}
+
+type statusInterfaces struct {
+	Primary sys.Interface `json:"primary"`
+	VPN     sys.Interface `json:"vpn"`
+	// Groups maps route groups to their interfaces.
+	Groups map[string]sys.Interface `json:"groups,omitempty"`
+}
+
+type statusResponse struct {
+	Result *Result `json:"result,omitempty"`
+	Config struct {
+		Hash    string         `json:"hash"`
+		Sources []statusSource `json:"sources"`
+	} `json:"config"`
+	Domains     map[string][]statusRecord `json:"domains"`
+	Interfaces  *statusInterfaces         `json:"interfaces,omitempty"`
+	Routes      []string                  `json:"routes"`
+	RoutesError string                    `json:"routesError,omitempty"`
+	Overrides   struct {
+		Added   map[string]time.Time `json:"added"`
+		Removed map[string]time.Time `json:"removed"`
+	} `json:"overrides"`
+}
+
+func (s *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+
+	var resp statusResponse
+
+	if lastResult, ok := s.daemon.LastResult(); ok {
+		resp.Result = &lastResult
+		resp.Config.Hash = lastResult.ConfigHash
+		for _, info := range lastResult.ConfigSources {
+			source := statusSource{
+				Source:       info.Source,
+				Hash:         info.Hash,
+				SigningKeyID: info.SigningKeyID,
+				Stale:        info.Stale,
+			}
+			if info.StaleReason != nil {
+				source.StaleReason = info.StaleReason.Error()
+			}
+			resp.Config.Sources = append(resp.Config.Sources, source)
+		}
+	}
+
+	resp.Domains = make(map[string][]statusRecord)
+	for domain, records := range s.daemon.resolver.Records() {
+		for _, record := range records {
+			resp.Domains[domain] = append(resp.Domains[domain], statusRecord{
+				IP:        record.IP.String(),
+				ExpiresAt: record.ExpiresAt,
+			})
+		}
+	}
+
+	status, err := s.daemon.router.GetStatus(s.logger)
+	if err != nil {
+		resp.RoutesError = err.Error()
+	} else {
+		resp.Interfaces = &statusInterfaces{status.Primary, status.VPN, status.Groups}
+		resp.Routes = status.Routes
+	}
+
+	resp.Overrides.Added, resp.Overrides.Removed = s.daemon.overrides.snapshot()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *controlServer) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	s.logger.Info("control API: reconcile requested")
+	s.daemon.triggerReconcile()
+	writeJSON(w, http.StatusAccepted, struct{}{})
+}
+
+type confirmRequest struct {
+	// Plan is the ID of the blocked plan, from result.blockedPlan.id.
+	Plan string `json:"plan"`
+}
+
+// handleConfirm lets the plan blocked by churn limits in the last iteration
+// be applied. Only the plan that's currently blocked can be confirmed, so an
+// operator can't confirm changes they haven't seen.
+func (s *controlServer) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	var req confirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("bad request body: %v", err))
+		return
+	}
+	if len(req.Plan) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("plan is required"))
+		return
+	}
+	lastResult, ok := s.daemon.LastResult()
+	if !ok || lastResult.BlockedPlan == nil || lastResult.BlockedPlan.ID != req.Plan {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("plan %s isn't blocked", req.Plan))
+		return
+	}
+	s.logger.Sugar().Infof("control API: plan %s (%s) confirmed", req.Plan, lastResult.BlockedPlan.Summary)
+	s.daemon.ConfirmPlan(req.Plan)
+	writeJSON(w, http.StatusAccepted, struct{}{})
+}
+
+type domainRequest struct {
+	Domain string `json:"domain"`
+	// TTL is a duration string like "30m". Defaults to 1h.
+	TTL string `json:"ttl"`
+}
+
+func (s *controlServer) handleDomain(do func(domain string, ttl time.Duration)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+		var req domainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("bad request body: %v", err))
+			return
+		}
+		if len(normalizeDomain(req.Domain)) == 0 {
+			writeJSONError(w, http.StatusBadRequest, errors.New("domain is required"))
+			return
+		}
+		if err := config.ValidateDomain(strings.TrimSpace(req.Domain)); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		ttl := defaultOverrideTTL
+		if len(req.TTL) > 0 {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("bad ttl: %q", req.TTL))
+				return
+			}
+		}
+		s.logger.Sugar().Infof("control API: %s %s (ttl %s)", r.URL.Path, req.Domain, ttl)
+		do(req.Domain, ttl)
+		s.daemon.triggerReconcile()
+		writeJSON(w, http.StatusAccepted, struct{}{})
+	}
+}
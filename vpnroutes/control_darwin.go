@@ -0,0 +1,45 @@
+package vpnroutes
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	solLocal      = 0 // SOL_LOCAL from <sys/un.h>
+	localPeerCred = 1 // LOCAL_PEERCRED from <sys/un.h>
+)
+
+// xucred mirrors struct xucred from <sys/ucred.h>.
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+}
+
+func peerCred(conn *net.UnixConn) (uid uint32, gids []uint32, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, nil, err
+	}
+	var cred xucred
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(cred))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeerCred,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	ngroups := int(cred.ngroups)
+	if ngroups > len(cred.groups) {
+		ngroups = len(cred.groups)
+	}
+	return cred.uid, cred.groups[:ngroups], nil
+}
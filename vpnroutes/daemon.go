@@ -0,0 +1,745 @@
+// Package vpnroutes keeps the system routing table in line with a vpnroutesd
+// config: domains and IPs listed in the config are routed through the VPN
+// interface, and everything else goes through the primary interface.
+//
+// It's what the vpnroutesd command runs, and can be embedded in other
+// programs:
+//
+//	d, err := vpnroutes.New(logger, vpnroutes.Options{
+//	    ConfigSources: []string{"/etc/vpnroutesd.toml"},
+//	    OnResult: func(r vpnroutes.Result) { ... },
+//	})
+//	...
+//	err = d.Run(ctx)
+package vpnroutes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/songgao/vpnroutesd/config"
+	"github.com/songgao/vpnroutesd/dns"
+	"github.com/songgao/vpnroutesd/health"
+	"github.com/songgao/vpnroutesd/metrics"
+	"github.com/songgao/vpnroutesd/sys"
+	"go.uber.org/zap"
+)
+
+const defaultInterval = time.Minute
+
+// defaultTimeouts are used for stages whose deadline isn't set in the config.
+// The config stage needs to cover an HTTPS fetch with its own connect and read
+// timeouts, or a keybase subprocess.
+var defaultTimeouts = config.Timeouts{
+	Config: 2 * time.Minute,
+	DNS:    30 * time.Second,
+	Routes: 30 * time.Second,
+}
+
+// withDefaults fills in zero fields of t from defaultTimeouts.
+func withDefaults(t config.Timeouts) config.Timeouts {
+	if t.Config <= 0 {
+		t.Config = defaultTimeouts.Config
+	}
+	if t.DNS <= 0 {
+		t.DNS = defaultTimeouts.DNS
+	}
+	if t.Routes <= 0 {
+		t.Routes = defaultTimeouts.Routes
+	}
+	return t
+}
+
+// Options configures a Daemon.
+type Options struct {
+	// ConfigSources are the config sources to load, in increasing precedence.
+	// See config.Loader.Load for what a source can be. Required.
+	ConfigSources []string
+	// Loader configures how config sources are loaded.
+	Loader config.LoaderOptions
+	// DNS configures how domains are resolved.
+	DNS dns.ResolverOptions
+	// Interfaces are the primary and VPN interfaces. Set to nil to auto detect.
+	Interfaces *sys.InterfaceNames
+	// KillSwitch makes VPN destinations unreachable while the VPN interface
+	// is absent, rather than leaving them to the primary interface. See
+	// sys.ApplyRoutesArgs.KillSwitch.
+	KillSwitch bool
+	// UnmanagedDefaultRoute leaves the default route alone, rather than keep
+	// it going through the primary interface. See
+	// sys.ApplyRoutesArgs.UnmanagedDefaultRoute.
+	UnmanagedDefaultRoute bool
+	// UnprotectedDNSServer lets the config's DNSServer go through a VPN or
+	// group interface when a CIDR covers it. By default, it's kept going
+	// through the primary interface unless it's listed as an IP on its own.
+	UnprotectedDNSServer bool
+	// ChurnLimits blocks route changes that add or delete too many routes
+	// at once, until they're confirmed with ConfirmPlan or through the
+	// control API. Limits aren't enforced when the health check policy of
+	// the VPN or of a group takes effect or lifts, nor when the kill switch
+	// engages or releases.
+	ChurnLimits sys.ChurnLimits
+	// Damping configures flap damping of IPs resolved from domains. It's off
+	// unless Damping.HalfLife is set.
+	Damping DampingOptions
+	// Router configures how the routing table is managed.
+	Router sys.RouterOptions
+
+	// Interval is how often Run reconciles. Defaults to 1 minute.
+	Interval time.Duration
+	// WatchLocalConfig makes Run reconcile right away when a local config
+	// file changes, rather than on the next tick.
+	WatchLocalConfig bool
+
+	// ControlSocket, if not empty, is the path to a Unix socket Run serves the
+	// control API on.
+	ControlSocket string
+	// ControlGroup is a group allowed to use the control API in addition to
+	// root.
+	ControlGroup string
+
+	// OnResult, if not nil, is called with the result of every reconcile
+	// iteration, whether run by Run or Reconcile. It's called synchronously,
+	// so it should return quickly.
+	OnResult func(Result)
+}
+
+// Daemon reconciles the system routing table with the config. It can either
+// run continuously with Run, or one iteration at a time with Reconcile.
+type Daemon struct {
+	logger *zap.Logger
+	opts   Options
+
+	loader    *config.Loader
+	resolver  *dns.Resolver
+	router    *sys.Router
+	overrides *domainOverrides
+
+	// reconcileRequests is signaled when Run should reconcile right away.
+	reconcileRequests chan struct{}
+
+	// reconcileLock serializes reconcile iterations, and guards timeouts.
+	reconcileLock sync.Mutex
+	// timeouts are the stage deadlines from the last loaded config. Since the
+	// deadline for loading the config has to be known before the config is
+	// loaded, a new Timeouts.Config only applies from the next iteration.
+	timeouts config.Timeouts
+	// vpnHealthy is whether the VPN passed the last health check, and
+	// unhealthyGroups are the route groups whose interface failed it. Also
+	// guarded by reconcileLock.
+	vpnHealthy      bool
+	unhealthyGroups map[string]bool
+	// appliedPolicies are the health check policies in effect when routes
+	// were last applied. See Result.healthPolicies.
+	appliedPolicies map[string]config.FailurePolicy
+	// damper is nil if flap damping is disabled. Also guarded by
+	// reconcileLock.
+	damper *flapDamper
+
+	lock       sync.Mutex
+	lastResult *Result
+	// confirmedPlan is the ID of a plan blocked by ChurnLimits that the
+	// operator has confirmed. Guarded by lock.
+	confirmedPlan string
+}
+
+// New creates a Daemon. It doesn't touch the routing table until Run or
+// Reconcile is called.
+func New(logger *zap.Logger, opts Options) (*Daemon, error) {
+	if len(opts.ConfigSources) == 0 {
+		return nil, errors.New("no config source")
+	}
+	if opts.Interfaces != nil && (len(opts.Interfaces.Primary) == 0 || len(opts.Interfaces.VPN) == 0) {
+		return nil, errors.New("primary and VPN interfaces must be set together")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	loader, err := config.NewLoader(opts.Loader)
+	if err != nil {
+		return nil, err
+	}
+	return &Daemon{
+		logger:            logger,
+		opts:              opts,
+		loader:            loader,
+		resolver:          dns.NewResolver(opts.DNS),
+		router:            sys.NewRouter(opts.Router),
+		overrides:         newDomainOverrides(),
+		reconcileRequests: make(chan struct{}, 1),
+		timeouts:          defaultTimeouts,
+		vpnHealthy:        true,
+		unhealthyGroups:   make(map[string]bool),
+		damper:            newFlapDamper(opts.Damping),
+	}, nil
+}
+
+// LastResult returns the result of the last reconcile iteration, or false if
+// none has finished yet.
+func (d *Daemon) LastResult() (Result, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.lastResult == nil {
+		return Result{}, false
+	}
+	return *d.lastResult, true
+}
+
+// ConfirmPlan allows the route changes of the plan with the given ID, which
+// was blocked by Options.ChurnLimits, to be applied, and reconciles as soon
+// as possible. If the plan has changed by then, e.g. because DNS answers
+// have, it's blocked again under a new ID.
+func (d *Daemon) ConfirmPlan(id string) {
+	d.lock.Lock()
+	d.confirmedPlan = id
+	d.lock.Unlock()
+	d.triggerReconcile()
+}
+
+// triggerReconcile asks Run to reconcile as soon as possible. Multiple
+// triggers before Run gets to it are coalesced.
+func (d *Daemon) triggerReconcile() {
+	select {
+	case d.reconcileRequests <- struct{}{}:
+	default:
+	}
+}
+
+// Run reconciles right away, and then every Interval, and when requested
+// through the control API or by a local config change, until ctx is done. It
+// always returns a non-nil error: ctx.Err() if ctx is done.
+func (d *Daemon) Run(ctx context.Context) error {
+	if len(d.opts.ControlSocket) > 0 {
+		ctl := newControlServer(d.logger, d)
+		ctlDone := make(chan struct{})
+		// Wait for the control server to remove its socket before returning.
+		defer func() { <-ctlDone }()
+		go func() {
+			defer close(ctlDone)
+			if err := ctl.serve(ctx, d.opts.ControlSocket, d.opts.ControlGroup); err != nil {
+				d.logger.Sugar().Errorf("control API error: %v", err)
+			}
+		}()
+	}
+
+	// Local config files are watched so changes apply right away. Remote ones
+	// are only picked up on the next tick.
+	var watcher *config.Watcher
+	if d.opts.WatchLocalConfig {
+		var err error
+		watcher, err = config.NewWatcher(d.logger, func() {
+			d.logger.Info("local config changed")
+			d.triggerReconcile()
+		})
+		if err != nil {
+			d.logger.Sugar().Warnf("not watching local config files: %v", err)
+		} else {
+			defer watcher.Close()
+			watcher.SetSources(d.opts.ConfigSources)
+		}
+	}
+
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+	first := make(chan struct{}, 1)
+	first <- struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-first:
+		case <-d.reconcileRequests:
+		}
+		result, _ := d.Reconcile(ctx)
+		if watcher != nil && len(result.ConfigSources) > 0 {
+			// Includes may have changed.
+			sources := make([]string, 0, len(result.ConfigSources))
+			for _, info := range result.ConfigSources {
+				sources = append(sources, info.Source)
+			}
+			watcher.SetSources(sources)
+		}
+	}
+}
+
+// Reconcile runs a single reconcile iteration: it loads the config, resolves
+// domains, and applies routes. It returns the result, along with the error of
+// the first stage that failed, if any. Each stage runs with the deadline set
+// in the config's Timeouts, or a default. If ctx is done before a stage
+// starts, that stage fails with ctx.Err(). Concurrent calls run one after
+// another.
+func (d *Daemon) Reconcile(ctx context.Context) (Result, error) {
+	d.reconcileLock.Lock()
+	defer d.reconcileLock.Unlock()
+
+	result := d.run(ctx)
+	d.lock.Lock()
+	d.lastResult = &result
+	d.lock.Unlock()
+	result.recordMetrics()
+	d.logger.Info("Iteration", zap.Object("result", result))
+	if d.opts.OnResult != nil {
+		d.opts.OnResult(result)
+	}
+	return result, result.Err()
+}
+
+func dedupIPs(ips ...[]net.IP) []net.IP {
+	m := make(map[string]net.IP)
+	for _, l := range ips {
+		for _, ip := range l {
+			m[ip.String()] = ip
+		}
+	}
+	ret := make([]net.IP, 0, len(m))
+	for _, ip := range m {
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// logOrigins logs which config source each entry comes from.
+func logOrigins(logger *zap.Logger, cfg config.Config) {
+	entries := make([]string, 0, len(cfg.Origins))
+	for entry := range cfg.Origins {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	for _, entry := range entries {
+		logger.Sugar().Infof("config entry %s added by %s", entry, cfg.Origins[entry])
+	}
+	for _, g := range cfg.Groups {
+		entries = entries[:0]
+		for entry := range g.Origins {
+			entries = append(entries, entry)
+		}
+		sort.Strings(entries)
+		for _, entry := range entries {
+			logger.Sugar().Infof("config entry %s in group %s added by %s", entry, g.Name, g.Origins[entry])
+		}
+	}
+}
+
+// canceled returns a failed StageResult if ctx is done.
+func canceled(ctx context.Context) (StageResult, bool) {
+	if err := ctx.Err(); err != nil {
+		return StageResult{Status: StageFailed, Err: err}, true
+	}
+	return StageResult{}, false
+}
+
+func (d *Daemon) run(ctx context.Context) (result Result) {
+	logger := d.logger
+	logger.Debug("+ run")
+	defer logger.Debug("- run")
+
+	result.StartedAt = time.Now()
+	defer func() { result.Duration = time.Since(result.StartedAt) }()
+
+	var ok bool
+	if result.Config, ok = canceled(ctx); ok {
+		return result
+	}
+	stageStart := time.Now()
+	stageCtx, cancel := context.WithTimeout(ctx, d.timeouts.Config)
+	cfg, cfgChanged, err := d.loader.Load(stageCtx, logger, d.opts.ConfigSources)
+	cancel()
+	result.Config.Duration = time.Since(stageStart)
+	if err != nil {
+		logger.Sugar().Errorf("loading config error: %v", err.Error())
+		result.Config.Status, result.Config.Err = StageFailed, err
+		return result
+	}
+	d.timeouts = withDefaults(cfg.Timeouts)
+	result.Config.Status = changedStatus(cfgChanged)
+	if cfg.Stale {
+		result.Config.Status, result.Config.Err = StageStale, cfg.StaleReason
+	}
+	result.ConfigHash = cfg.Hash
+	result.ConfigSources = cfg.Sources
+	if cfgChanged && len(cfg.Sources) > 1 {
+		logOrigins(logger, cfg)
+	}
+	cfg.VPNDomains = d.overrides.apply(cfg.VPNDomains)
+	logger.Sugar().Debugf("using config: %s", cfg)
+
+	if result.DNS, ok = canceled(ctx); ok {
+		return result
+	}
+	stageStart = time.Now()
+	groups := []*routeGroup{{
+		name:       config.DefaultGroup,
+		domains:    cfg.VPNDomains,
+		cidrs:      cfg.VPNCIDRs,
+		attrs:      cfg.Attributes,
+		entryAttrs: cfg.EntryAttributes,
+	}}
+	for _, g := range cfg.Groups {
+		groups = append(groups, &routeGroup{
+			name:       g.Name,
+			domains:    g.Domains,
+			cidrs:      g.CIDRs,
+			attrs:      g.Attributes,
+			entryAttrs: g.EntryAttributes,
+		})
+	}
+	stageCtx, cancel = context.WithTimeout(ctx, d.timeouts.DNS)
+	byDomain, dnsChanged, err := d.resolver.GetIPsByDomain(stageCtx, logger, cfg.DNSServer, allDomains(groups))
+	cancel()
+	result.DNS.Duration = time.Since(stageStart)
+	// DNS problems don't stop routes from being applied. Domains that failed
+	// to resolve still have their remembered IPs, and static IPs and CIDRs
+	// don't depend on DNS at all.
+	result.DNS.Status = changedStatus(dnsChanged)
+	if failed, ok := err.(dns.LookupErrors); ok {
+		logger.Sugar().Warnf("GetIPs: %v", err)
+		result.DNS.Status, result.DNS.Err = StagePartial, err
+		result.FailedDomains = make(map[string]string, len(failed))
+		for domain, domainErr := range failed {
+			result.FailedDomains[domain] = domainErr.Error()
+		}
+	} else if err != nil {
+		logger.Sugar().Errorf("GetIPs error: %v", err)
+		result.DNS.Status, result.DNS.Err = StageFailed, err
+	}
+	var domainIPs []net.IP
+	for _, ips := range byDomain {
+		domainIPs = append(domainIPs, ips...)
+	}
+	result.DomainIPs = len(dedupIPs(domainIPs))
+	logger.Sugar().Debugf("IPs from DNS: %s", dedupIPs(domainIPs))
+	result.DampedIPs = d.damper.damp(logger, time.Now(), byDomain)
+
+	groups[0].ips = cfg.VPNIPs
+	for i, g := range cfg.Groups {
+		groups[i+1].ips = g.IPs
+	}
+	for _, g := range groups {
+		resolved := [][]net.IP{g.ips}
+		for _, domain := range g.domains {
+			resolved = append(resolved, byDomain[domain])
+		}
+		g.ips = dedupIPs(resolved...)
+		result.VPNIPs += len(g.ips)
+	}
+	result.RouteConflicts = resolveConflicts(groups)
+	for _, conflict := range result.RouteConflicts {
+		logger.Sugar().Warnf("route conflict: %s", conflict)
+	}
+
+	args := sys.ApplyRoutesArgs{
+		Interfaces:            d.opts.Interfaces,
+		VPNIPs:                groups[0].ips,
+		VPNCIDRs:              groups[0].cidrs,
+		KillSwitch:            d.opts.KillSwitch,
+		UnmanagedDefaultRoute: d.opts.UnmanagedDefaultRoute,
+	}
+	for i, g := range cfg.Groups {
+		args.Groups = append(args.Groups, toSysGroup(g, groups[i+1]))
+	}
+	args.Attributes = make(map[string]sys.RouteAttributes)
+	for _, g := range groups {
+		g.addAttributes(args.Attributes, byDomain)
+	}
+	// The DNS server is only routed through a VPN if it's listed as an IP
+	// on its own. Otherwise, it's taken to be covered by accident, e.g. by a
+	// CIDR, and lookups would break whenever the VPN does.
+	if !d.opts.UnprotectedDNSServer && !dnsServerListed(cfg) {
+		args.Protected = append(args.Protected, sys.ProtectedIP{IP: cfg.DNSServer, Reason: "DNS server"})
+	}
+
+	if result.Health, ok = canceled(ctx); ok {
+		return result
+	}
+	if healthChecked(cfg) {
+		stageStart = time.Now()
+		// Probes have their own timeout, so the stage deadline only needs to
+		// cover them plus interface detection.
+		stageCtx, cancel = context.WithTimeout(ctx, d.timeouts.Routes)
+		vpnErr, groupErrs := d.checkHealth(stageCtx, cfg, args.Groups)
+		cancel()
+		result.Health.Duration = time.Since(stageStart)
+		changed := (vpnErr == nil) != d.vpnHealthy || len(groupErrs) != len(d.unhealthyGroups)
+		for name := range groupErrs {
+			changed = changed || !d.unhealthyGroups[name]
+		}
+		result.Health.Status = changedStatus(changed)
+		var failed []string
+		if vpnErr != nil {
+			logger.Sugar().Warnf("VPN health check failed: %v", vpnErr)
+			failed = append(failed, fmt.Sprintf("VPN: %v", vpnErr))
+			// The kill switch already rejects VPN destinations when the VPN
+			// interface is gone; withdrawing them would defeat it.
+			if !(args.KillSwitch && vpnErr == sys.ErrVPNInterfaceNotFound) {
+				result.HealthAction = withHealthPolicy(&args, config.DefaultGroup, cfg.Health.OnFailure)
+			}
+		} else if !d.vpnHealthy {
+			logger.Sugar().Infof("VPN is healthy again")
+		}
+		d.vpnHealthy = vpnErr == nil
+		if d.vpnHealthy {
+			metrics.VPNHealthy.Set(1)
+		} else {
+			metrics.VPNHealthy.Set(0)
+		}
+		for _, g := range cfg.Groups {
+			if g.Health.Empty() {
+				continue
+			}
+			if groupErr, ok := groupErrs[g.Name]; ok {
+				logger.Sugar().Warnf("group %s health check failed: %v", g.Name, groupErr)
+				failed = append(failed, fmt.Sprintf("group %s: %v", g.Name, groupErr))
+				if result.GroupHealthActions == nil {
+					result.GroupHealthActions = make(map[string]config.FailurePolicy)
+				}
+				// Like the VPN's, destinations of a group whose interface
+				// is gone are already rejected by the kill switch.
+				if _, absent := groupErr.(groupInterfaceError); !(args.KillSwitch && absent) {
+					result.GroupHealthActions[g.Name] = withHealthPolicy(&args, g.Name, g.Health.OnFailure)
+				}
+				metrics.GroupHealthy.Set(0, g.Name)
+			} else {
+				if d.unhealthyGroups[g.Name] {
+					logger.Sugar().Infof("group %s is healthy again", g.Name)
+				}
+				metrics.GroupHealthy.Set(1, g.Name)
+			}
+		}
+		d.unhealthyGroups = make(map[string]bool, len(groupErrs))
+		for name := range groupErrs {
+			d.unhealthyGroups[name] = true
+		}
+		if len(failed) > 0 {
+			result.Health.Status = StageFailed
+			result.Health.Err = fmt.Errorf("health check failed: %s", strings.Join(failed, "; "))
+		}
+	}
+
+	if result.Routes, ok = canceled(ctx); ok {
+		return result
+	}
+	policies := result.healthPolicies()
+	if args.Limits = d.churnLimits(policies); args.Limits != d.opts.ChurnLimits {
+		logger.Sugar().Infof("health check policies changed; not enforcing churn limits")
+	}
+	d.lock.Lock()
+	args.ConfirmedPlan = d.confirmedPlan
+	d.lock.Unlock()
+
+	stageStart = time.Now()
+	stageCtx, cancel = context.WithTimeout(ctx, d.timeouts.Routes)
+	applied, err := d.router.ApplyRoutes(stageCtx, logger, args)
+	cancel()
+	result.Routes.Duration = time.Since(stageStart)
+	if _, ok := err.(*sys.VerificationError); ok || err == nil {
+		d.appliedPolicies = policies
+	}
+	result.RoutesAdded = applied.Added
+	result.RoutesReplaced = applied.Replaced
+	result.RoutesDeleted = applied.Deleted
+	result.RoutesRolledBack = applied.RolledBack
+	result.Protections = applied.Protections
+	result.KillSwitch = applied.KillSwitch
+	if applied.DefaultGateway != nil {
+		result.DefaultGateway = applied.DefaultGateway.String()
+	}
+	if verr, ok := err.(*sys.VerificationError); ok {
+		result.Routes.Status, result.Routes.Err = StageMismatch, err
+		for _, m := range verr.Mismatches {
+			result.RouteMismatches = append(result.RouteMismatches, m.String())
+		}
+		return result
+	}
+	if cerr, ok := err.(*sys.ChurnLimitError); ok {
+		result.Routes.Status, result.Routes.Err = StageBlocked, err
+		result.BlockedPlan = &BlockedPlan{ID: cerr.PlanID, Summary: cerr.Summary, Exceeded: cerr.Exceeded}
+		return result
+	}
+	if err != nil {
+		logger.Sugar().Errorf("ApplyRoutes error: %v", err)
+		result.Routes.Status, result.Routes.Err = StageFailed, err
+		return result
+	}
+	result.Routes.Status = changedStatus(applied.Changed())
+	if len(args.ConfirmedPlan) > 0 {
+		d.lock.Lock()
+		if d.confirmedPlan == args.ConfirmedPlan {
+			d.confirmedPlan = ""
+		}
+		d.lock.Unlock()
+	}
+	// A missing VPN interface only takes out VPN destinations, the same as a
+	// missing group interface does for the group's.
+	if applied.VPNErr != nil {
+		if applied.GroupErrors == nil {
+			applied.GroupErrors = make(map[string]error)
+		}
+		applied.GroupErrors[config.DefaultGroup] = applied.VPNErr
+	}
+	if len(applied.GroupErrors) > 0 {
+		result.GroupErrors = make(map[string]string, len(applied.GroupErrors))
+		var names []string
+		for name, groupErr := range applied.GroupErrors {
+			result.GroupErrors[name] = groupErr.Error()
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		result.Routes.Status = StagePartial
+		result.Routes.Err = fmt.Errorf("interfaces not found for groups: %s", strings.Join(names, ", "))
+	}
+
+	return result
+}
+
+// dnsServerListed returns true if cfg.DNSServer is listed as a VPN or group
+// IP.
+func dnsServerListed(cfg config.Config) bool {
+	lists := [][]net.IP{cfg.VPNIPs}
+	for _, g := range cfg.Groups {
+		lists = append(lists, g.IPs)
+	}
+	for _, ips := range lists {
+		for _, ip := range ips {
+			if ip.Equal(cfg.DNSServer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// healthChecked returns true if cfg has probes for the VPN or any group.
+func healthChecked(cfg config.Config) bool {
+	if !cfg.Health.Empty() {
+		return true
+	}
+	for _, g := range cfg.Groups {
+		if !g.Health.Empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// groupInterfaceError is why a group failed its health check when its
+// interface can't be found.
+type groupInterfaceError struct {
+	err error
+}
+
+func (e groupInterfaceError) Error() string {
+	return fmt.Sprintf("interface not found: %v", e.err)
+}
+
+// checkHealth detects the VPN interface and the interface of each group in
+// cfg with probes, and sends their probes through them, all at the same time.
+// groups are the sys.RouteGroup of cfg.Groups, to find interfaces with.
+// vpnErr is set if the VPN fails its check, and groupErrs maps groups that
+// fail theirs to why.
+func (d *Daemon) checkHealth(ctx context.Context, cfg config.Config, groups []sys.RouteGroup) (vpnErr error, groupErrs map[string]error) {
+	var checked []sys.RouteGroup
+	groupHealth := make(map[string]config.HealthCheck)
+	for i, g := range cfg.Groups {
+		if !g.Health.Empty() {
+			checked = append(checked, groups[i])
+			groupHealth[g.Name] = g.Health
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	groupErrs = make(map[string]error)
+	if len(checked) > 0 {
+		ifces, errs, err := d.router.DetectGroupInterfaces(ctx, d.logger, d.opts.Interfaces, checked)
+		for _, g := range checked {
+			if err != nil {
+				groupErrs[g.Name] = err
+			} else if ifceErr, ok := errs[g.Name]; ok {
+				groupErrs[g.Name] = groupInterfaceError{ifceErr}
+			}
+		}
+		for name, ifce := range ifces {
+			wg.Add(1)
+			go func(name string, ifce sys.Interface) {
+				defer wg.Done()
+				if err := health.Check(ctx, d.logger, ifce, groupHealth[name]); err != nil {
+					lock.Lock()
+					groupErrs[name] = err
+					lock.Unlock()
+				}
+			}(name, ifce)
+		}
+	}
+	if !cfg.Health.Empty() {
+		var vpn sys.Interface
+		if _, vpn, vpnErr = d.router.DetectInterfaces(ctx, d.logger, d.opts.Interfaces); vpnErr == nil {
+			vpnErr = health.Check(ctx, d.logger, vpn, cfg.Health)
+		}
+	}
+	wg.Wait()
+	return vpnErr, groupErrs
+}
+
+// withHealthPolicy changes args according to policy, for when the VPN, or
+// the interface of the named group, fails its health check, and returns the
+// policy applied.
+func withHealthPolicy(args *sys.ApplyRoutesArgs, group string, policy config.FailurePolicy) config.FailurePolicy {
+	ips, cidrs := &args.VPNIPs, &args.VPNCIDRs
+	for i := range args.Groups {
+		if args.Groups[i].Name == group {
+			ips, cidrs = &args.Groups[i].IPs, &args.Groups[i].CIDRs
+		}
+	}
+	switch policy {
+	case config.FailureWithdraw:
+		*ips, *cidrs = nil, nil
+	case config.FailureReject:
+		args.RejectIPs = append(args.RejectIPs, *ips...)
+		args.RejectCIDRs = append(args.RejectCIDRs, *cidrs...)
+		*ips, *cidrs = nil, nil
+	default:
+		policy = config.FailureKeep
+	}
+	return policy
+}
+
+// churnLimits returns the limits to enforce on routes applied with the
+// health check policies in policies. A policy taking effect or lifting
+// withdraws or rejects routes, or puts them back, all at once, which is what
+// it's meant to do, so no limits are enforced then.
+func (d *Daemon) churnLimits(policies map[string]config.FailurePolicy) sys.ChurnLimits {
+	if samePolicies(policies, d.appliedPolicies) {
+		return d.opts.ChurnLimits
+	}
+	return sys.ChurnLimits{}
+}
+
+func samePolicies(a, b map[string]config.FailurePolicy) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, policy := range a {
+		if b[name] != policy {
+			return false
+		}
+	}
+	return true
+}
+
+// recordMetrics counts the iteration by result for each stage, and records
+// how long each stage that ran took.
+func (r Result) recordMetrics() {
+	for _, stage := range r.stages() {
+		metrics.RunIterations.Inc(stage.name, stage.result.Status.String())
+		if stage.result.Status != StageSkipped {
+			metrics.RunStageDuration.Observe(stage.result.Duration.Seconds(), stage.name)
+		}
+	}
+}
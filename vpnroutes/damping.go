@@ -0,0 +1,153 @@
+package vpnroutes
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/songgao/vpnroutesd/metrics"
+	"go.uber.org/zap"
+)
+
+// Some domains answer with a different subset of a large pool on each query,
+// so their IPs keep appearing and expiring, and their routes keep being added
+// and deleted. Flap damping, much like BGP's, keeps such IPs routed instead:
+//
+//   - Each IP of a domain has a penalty, which halves every HalfLife.
+//   - Each time the IP is withdrawn, i.e. it was routed but the domain no
+//     longer resolves to it, the penalty grows by flapPenalty.
+//   - If that brings the penalty to suppressPenalty or more, the withdrawal
+//     is suppressed, and the IP stays routed as if the domain still resolved
+//     to it. It's only withdrawn once the penalty decays below reusePenalty,
+//     or right away if the domain drops out of the config.
+//   - The penalty never grows beyond what decays to reusePenalty within
+//     MaxSuppress, so an IP isn't kept routed for longer than that after its
+//     last flap.
+
+const (
+	flapPenalty     = 1000
+	suppressPenalty = 2000
+	reusePenalty    = 750
+	// An IP that's not routed is forgotten once its penalty decays below
+	// forgetPenalty.
+	forgetPenalty = reusePenalty / 2
+
+	defaultMaxSuppressHalfLives = 4
+)
+
+// DampingOptions configures flap damping of IPs resolved from domains.
+type DampingOptions struct {
+	// HalfLife is how long it takes the penalty of an IP to halve. Zero
+	// disables flap damping.
+	HalfLife time.Duration
+	// MaxSuppress limits how long an IP is kept routed after it was last
+	// withdrawn. Defaults to 4 half-lives.
+	MaxSuppress time.Duration
+}
+
+type flapKey struct {
+	domain string
+	ip     string
+}
+
+type flapState struct {
+	ip      net.IP
+	penalty float64
+	updated time.Time
+	// routed is true if the IP was routed after the last iteration, either
+	// because the domain resolved to it or because it was damped.
+	routed bool
+	damped bool
+}
+
+// flapDamper keeps track of IPs resolved from domains across reconcile
+// iterations. It's not safe for concurrent use.
+type flapDamper struct {
+	halfLife time.Duration
+	ceiling  float64
+	states   map[flapKey]*flapState
+}
+
+func newFlapDamper(opts DampingOptions) *flapDamper {
+	if opts.HalfLife <= 0 {
+		return nil
+	}
+	if opts.MaxSuppress <= 0 {
+		opts.MaxSuppress = defaultMaxSuppressHalfLives * opts.HalfLife
+	}
+	ceiling := reusePenalty * math.Exp2(float64(opts.MaxSuppress)/float64(opts.HalfLife))
+	return &flapDamper{
+		halfLife: opts.HalfLife,
+		ceiling:  math.Max(ceiling, suppressPenalty),
+		states:   make(map[flapKey]*flapState),
+	}
+}
+
+func (s *flapState) decay(now time.Time, halfLife time.Duration) {
+	s.penalty *= math.Exp2(-float64(now.Sub(s.updated)) / float64(halfLife))
+	s.updated = now
+}
+
+// damp adds IPs whose withdrawal is suppressed back to their domains in
+// byDomain, and returns how many distinct IPs it added. byDomain is what
+// dns.Resolver.GetIPsByDomain returns for every configured domain. A nil
+// flapDamper doesn't damp anything.
+func (f *flapDamper) damp(logger *zap.Logger, now time.Time, byDomain map[string][]net.IP) int {
+	if f == nil {
+		return 0
+	}
+	domains := make(map[string]string, len(byDomain))
+	seen := make(map[flapKey]bool)
+	for domain, ips := range byDomain {
+		domains[normalizeDomain(domain)] = domain
+		for _, ip := range ips {
+			key := flapKey{normalizeDomain(domain), ip.String()}
+			seen[key] = true
+			s, ok := f.states[key]
+			if !ok {
+				s = &flapState{ip: ip, updated: now}
+				f.states[key] = s
+			}
+			s.decay(now, f.halfLife)
+			s.routed, s.damped = true, false
+		}
+	}
+
+	damped := make(map[string]bool)
+	for key, s := range f.states {
+		if seen[key] {
+			continue
+		}
+		domain, ok := domains[key.domain]
+		if !ok {
+			// Domains no longer in the config don't keep their IPs routed.
+			delete(f.states, key)
+			continue
+		}
+		s.decay(now, f.halfLife)
+		switch {
+		case !s.routed:
+		case s.damped && s.penalty < reusePenalty:
+			logger.Sugar().Infof("flap damping: withdrawing %s of %s; penalty decayed to %.0f", key.ip, key.domain, s.penalty)
+			s.routed, s.damped = false, false
+		case s.damped:
+		default:
+			s.penalty = math.Min(s.penalty+flapPenalty, f.ceiling)
+			if s.penalty < suppressPenalty {
+				s.routed = false
+				break
+			}
+			logger.Sugar().Infof("flap damping: keeping %s of %s routed; penalty %.0f", key.ip, key.domain, s.penalty)
+			s.damped = true
+		}
+		if s.damped {
+			byDomain[domain] = append(byDomain[domain], s.ip)
+			damped[key.ip] = true
+		} else if !s.routed && s.penalty < forgetPenalty {
+			delete(f.states, key)
+		}
+	}
+
+	metrics.RoutesDamped.Set(float64(len(damped)))
+	return len(damped)
+}
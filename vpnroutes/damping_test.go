@@ -0,0 +1,119 @@
+package vpnroutes
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testDomain = "pool.example.com"
+
+type dampingStep struct {
+	name string
+	// at is the time of the step, from the start of the test.
+	at time.Duration
+	// resolved are the IPs testDomain resolves to. nil drops the domain from
+	// the config.
+	resolved []string
+	// routed are the IPs of testDomain after damping, and damped how many of
+	// them damping added back.
+	routed []string
+	damped int
+}
+
+func runDampingSteps(t *testing.T, f *flapDamper, steps []dampingStep) {
+	start := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	for _, step := range steps {
+		byDomain := make(map[string][]net.IP)
+		if step.resolved != nil {
+			byDomain[testDomain] = []net.IP{}
+			for _, ip := range step.resolved {
+				byDomain[testDomain] = append(byDomain[testDomain], net.ParseIP(ip))
+			}
+		}
+		damped := f.damp(zap.NewNop(), start.Add(step.at), byDomain)
+		var routed []string
+		for _, ip := range byDomain[testDomain] {
+			routed = append(routed, ip.String())
+		}
+		if !reflect.DeepEqual(routed, step.routed) || damped != step.damped {
+			t.Fatalf("%s: got %v routed, %d damped; want %v, %d", step.name, routed, damped, step.routed, step.damped)
+		}
+	}
+}
+
+func TestFlapDamping(t *testing.T) {
+	f := newFlapDamper(DampingOptions{HalfLife: time.Hour})
+	runDampingSteps(t, f, []dampingStep{
+		{name: "first answer", resolved: []string{"10.0.0.1", "10.0.0.2"}, routed: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "first flap is below the suppress penalty", resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+		{name: "answered again", resolved: []string{"10.0.0.1", "10.0.0.2"}, routed: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "second flap is suppressed", resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1", "10.0.0.2"}, damped: 1},
+		{name: "kept routed above the reuse penalty", at: time.Hour, resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1", "10.0.0.2"}, damped: 1},
+		{name: "withdrawn below the reuse penalty", at: 2 * time.Hour, resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+	})
+
+	key := flapKey{testDomain, "10.0.0.2"}
+	if s := f.states[key]; s == nil || s.routed || s.damped {
+		t.Fatalf("withdrawn IP: got state %+v, want remembered as not routed", s)
+	}
+	runDampingSteps(t, f, []dampingStep{
+		{name: "forgotten below the forget penalty", at: 3 * time.Hour, resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+	})
+	if s := f.states[key]; s != nil {
+		t.Errorf("forgotten IP: got state %+v, want none", s)
+	}
+}
+
+func TestFlapDampingDomainDropped(t *testing.T) {
+	f := newFlapDamper(DampingOptions{HalfLife: time.Hour})
+	runDampingSteps(t, f, []dampingStep{
+		{name: "first answer", resolved: []string{"10.0.0.1", "10.0.0.2"}, routed: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "first flap", resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+		{name: "answered again", resolved: []string{"10.0.0.1", "10.0.0.2"}, routed: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "second flap is suppressed", resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1", "10.0.0.2"}, damped: 1},
+		{name: "dropped from the config", resolved: nil, routed: nil},
+	})
+	if len(f.states) != 0 {
+		t.Errorf("got states %v, want none", f.states)
+	}
+}
+
+func TestFlapDampingMaxSuppress(t *testing.T) {
+	f := newFlapDamper(DampingOptions{HalfLife: time.Hour, MaxSuppress: 2 * time.Hour})
+	if want := float64(4 * reusePenalty); f.ceiling != want {
+		t.Fatalf("got ceiling %.0f, want %.0f", f.ceiling, want)
+	}
+	var steps []dampingStep
+	for i := 0; i < 10; i++ {
+		steps = append(steps,
+			dampingStep{name: "answered", resolved: []string{"10.0.0.1", "10.0.0.2"}, routed: []string{"10.0.0.1", "10.0.0.2"}},
+			dampingStep{name: "flap", resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+		)
+	}
+	// The first flap isn't suppressed, but all the others are.
+	for i := 3; i < len(steps); i += 2 {
+		steps[i].routed, steps[i].damped = []string{"10.0.0.1", "10.0.0.2"}, 1
+	}
+	steps = append(steps,
+		dampingStep{name: "kept routed until MaxSuppress", at: 2*time.Hour - time.Minute, resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1", "10.0.0.2"}, damped: 1},
+		dampingStep{name: "withdrawn after MaxSuppress", at: 2*time.Hour + time.Minute, resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+	)
+	runDampingSteps(t, f, steps)
+}
+
+func TestFlapDampingDisabled(t *testing.T) {
+	f := newFlapDamper(DampingOptions{})
+	if f != nil {
+		t.Fatalf("got %+v, want nil", f)
+	}
+	runDampingSteps(t, f, []dampingStep{
+		{name: "first answer", resolved: []string{"10.0.0.1", "10.0.0.2"}, routed: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "flap", resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+		{name: "answered again", resolved: []string{"10.0.0.1", "10.0.0.2"}, routed: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "flap again", resolved: []string{"10.0.0.1"}, routed: []string{"10.0.0.1"}},
+	})
+}
@@ -0,0 +1,149 @@
+package vpnroutes
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/songgao/vpnroutesd/config"
+	"github.com/songgao/vpnroutesd/sys"
+)
+
+// routeGroup is the resolved destinations of the VPN interface, or of a route
+// group from the config.
+type routeGroup struct {
+	name    string
+	domains []string
+	ips     []net.IP
+	cidrs   []*net.IPNet
+
+	attrs      config.RouteAttributes
+	entryAttrs map[string]config.RouteAttributes
+}
+
+// addAttributes adds the route attributes of g's destinations to attrs, keyed
+// the way sys.ApplyRoutesArgs.Attributes is. Attributes of an IP or CIDR
+// override those of a domain resolving to the IP, which override those of
+// the group. If more than one domain resolves to an IP, the first one wins.
+func (g *routeGroup) addAttributes(attrs map[string]sys.RouteAttributes, byDomain map[string][]net.IP) {
+	ipDomains := make(map[string]string)
+	for _, domain := range g.domains {
+		for _, ip := range byDomain[domain] {
+			if _, ok := ipDomains[ip.String()]; !ok {
+				ipDomains[ip.String()] = normalizeDomain(domain)
+			}
+		}
+	}
+	add := func(dst string, a config.RouteAttributes) {
+		if !a.Empty() {
+			attrs[dst] = sys.RouteAttributes{MTU: a.MTU, AdvMSS: a.AdvMSS, Metric: a.Metric}
+		}
+	}
+	for _, ip := range g.ips {
+		a := g.attrs
+		if domain, ok := ipDomains[ip.String()]; ok {
+			a = a.Override(g.entryAttrs[domain])
+		}
+		add(hostCIDR(ip).String(), a.Override(g.entryAttrs[ip.String()]))
+	}
+	for _, cidr := range g.cidrs {
+		add(cidr.String(), g.attrs.Override(g.entryAttrs[cidr.String()]))
+	}
+}
+
+// allDomains returns the domains of all groups, each only once.
+func allDomains(groups []*routeGroup) (domains []string) {
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		for _, domain := range g.domains {
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return domains
+}
+
+// destination is a host IP or a CIDR claimed by a group.
+type destination struct {
+	group string
+	cidr  *net.IPNet
+}
+
+func hostCIDR(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+}
+
+func (d destination) String() string {
+	if ones, _ := d.cidr.Mask.Size(); ones == 32 {
+		return d.cidr.IP.String()
+	}
+	return d.cidr.String()
+}
+
+// contains returns true if every address in b is in a.
+func contains(a, b *net.IPNet) bool {
+	onesA, _ := a.Mask.Size()
+	onesB, _ := b.Mask.Size()
+	return onesA <= onesB && a.Contains(b.IP)
+}
+
+// resolveConflicts finds destinations that overlap between groups. groups are
+// in priority order. A destination that would take traffic away from a
+// destination of an earlier group, because it's the same or more specific, is
+// dropped. Other overlaps are kept, since longest prefix matching already
+// routes the earlier group's destinations through its interface, but are
+// still reported.
+func resolveConflicts(groups []*routeGroup) (conflicts []string) {
+	var claimed []destination
+	conflict := func(d destination) (dropped bool) {
+		for _, c := range claimed {
+			if c.group == d.group || !(contains(c.cidr, d.cidr) || contains(d.cidr, c.cidr)) {
+				continue
+			}
+			if contains(c.cidr, d.cidr) {
+				conflicts = append(conflicts, fmt.Sprintf("%s in group %s overlaps %s in group %s; dropped from %s", d, d.group, c, c.group, d.group))
+				return true
+			}
+			conflicts = append(conflicts, fmt.Sprintf("%s in group %s overlaps %s in group %s; %s stays with %s", d, d.group, c, c.group, c, c.group))
+		}
+		return false
+	}
+	for _, g := range groups {
+		var ips []net.IP
+		var cidrs []*net.IPNet
+		var added []destination
+		for _, ip := range g.ips {
+			d := destination{g.name, hostCIDR(ip)}
+			if !conflict(d) {
+				ips = append(ips, ip)
+				added = append(added, d)
+			}
+		}
+		for _, cidr := range g.cidrs {
+			d := destination{g.name, cidr}
+			if !conflict(d) {
+				cidrs = append(cidrs, cidr)
+				added = append(added, d)
+			}
+		}
+		g.ips, g.cidrs = ips, cidrs
+		claimed = append(claimed, added...)
+	}
+	return conflicts
+}
+
+// toSysGroup converts a route group from the config, with destinations from
+// g, into what sys.Router takes.
+func toSysGroup(cfgGroup config.RouteGroup, g *routeGroup) sys.RouteGroup {
+	return sys.RouteGroup{
+		Name: g.name,
+		Interface: sys.InterfaceSelector{
+			Name:      cfgGroup.Interface,
+			Pattern:   cfgGroup.InterfacePattern,
+			VPNServer: cfgGroup.VPNServer,
+		},
+		IPs:   g.ips,
+		CIDRs: g.cidrs,
+	}
+}
@@ -0,0 +1,104 @@
+package vpnroutes
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// domainOverrides holds domains temporarily added to or removed from the
+// config through the control API. Overrides are kept in memory only, and are
+// dropped when they expire or when vpnroutesd restarts.
+type domainOverrides struct {
+	lock    sync.Mutex
+	added   map[string]time.Time
+	removed map[string]time.Time
+}
+
+func newDomainOverrides() *domainOverrides {
+	return &domainOverrides{
+		added:   make(map[string]time.Time),
+		removed: make(map[string]time.Time),
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func (o *domainOverrides) purgeExpiredLocked() {
+	now := time.Now()
+	for domain, expiresAt := range o.added {
+		if now.After(expiresAt) {
+			delete(o.added, domain)
+		}
+	}
+	for domain, expiresAt := range o.removed {
+		if now.After(expiresAt) {
+			delete(o.removed, domain)
+		}
+	}
+}
+
+func (o *domainOverrides) add(domain string, ttl time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	domain = normalizeDomain(domain)
+	delete(o.removed, domain)
+	o.added[domain] = time.Now().Add(ttl)
+}
+
+func (o *domainOverrides) remove(domain string, ttl time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	domain = normalizeDomain(domain)
+	delete(o.added, domain)
+	o.removed[domain] = time.Now().Add(ttl)
+}
+
+func (o *domainOverrides) reset(domain string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	domain = normalizeDomain(domain)
+	delete(o.added, domain)
+	delete(o.removed, domain)
+}
+
+// apply returns domains with overrides applied.
+func (o *domainOverrides) apply(domains []string) (ret []string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.purgeExpiredLocked()
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		normalized := normalizeDomain(domain)
+		if _, ok := o.removed[normalized]; ok {
+			continue
+		}
+		seen[normalized] = true
+		ret = append(ret, domain)
+	}
+	for domain := range o.added {
+		if !seen[domain] {
+			ret = append(ret, domain)
+		}
+	}
+	return ret
+}
+
+// snapshot returns copies of added and removed domains, keyed by domain and
+// valued by when the override expires.
+func (o *domainOverrides) snapshot() (added, removed map[string]time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.purgeExpiredLocked()
+	added = make(map[string]time.Time, len(o.added))
+	for domain, expiresAt := range o.added {
+		added[domain] = expiresAt
+	}
+	removed = make(map[string]time.Time, len(o.removed))
+	for domain, expiresAt := range o.removed {
+		removed[domain] = expiresAt
+	}
+	return added, removed
+}
@@ -0,0 +1,338 @@
+package vpnroutes
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/songgao/vpnroutesd/config"
+	"go.uber.org/zap/zapcore"
+)
+
+// StageStatus is the outcome of a single stage (config, dns, health or
+// routes) in a reconcile iteration.
+type StageStatus int
+
+const (
+	// StageSkipped means the stage didn't run because an earlier stage failed,
+	// or, for the health stage, because there are no probes configured.
+	StageSkipped StageStatus = iota
+	// StageUnchanged means the stage ran and its output is the same as last
+	// time.
+	StageUnchanged
+	// StageChanged means the stage ran and its output has changed since last
+	// time. For the health stage, that's the VPN becoming healthy or
+	// unhealthy.
+	StageChanged
+	// StageFailed means the stage ran and failed.
+	StageFailed
+	// StageStale means the config stage failed to load the config, and fell
+	// back to the last known good config.
+	StageStale
+	// StagePartial means the dns stage failed to resolve some domains, and
+	// used their remembered IPs instead, or the routes stage couldn't find
+	// the interfaces of some route groups, and applied the rest.
+	StagePartial
+	// StageMismatch means the routes stage applied routes, but the kernel
+	// doesn't route some destinations through the expected interface.
+	StageMismatch
+	// StageBlocked means the routes stage didn't apply routes, because they
+	// would change more than Options.ChurnLimits allow.
+	StageBlocked
+)
+
+func (s StageStatus) String() string {
+	switch s {
+	case StageSkipped:
+		return "SKIPPED"
+	case StageUnchanged:
+		return "UNCHANGED"
+	case StageChanged:
+		return "CHANGED"
+	case StageFailed:
+		return "ERR"
+	case StageStale:
+		return "STALE"
+	case StagePartial:
+		return "PARTIAL"
+	case StageMismatch:
+		return "MISMATCH"
+	case StageBlocked:
+		return "BLOCKED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s StageStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func changedStatus(changed bool) StageStatus {
+	if changed {
+		return StageChanged
+	}
+	return StageUnchanged
+}
+
+// StageResult describes how a single stage went.
+type StageResult struct {
+	Status StageStatus
+	// Err is set if Status is StageFailed, StageStale, StagePartial,
+	// StageMismatch or StageBlocked.
+	Err      error
+	Duration time.Duration
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler.
+func (r StageResult) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("status", r.Status.String())
+	if r.Err != nil {
+		enc.AddString("error", r.Err.Error())
+	}
+	enc.AddDuration("duration", r.Duration)
+	return nil
+}
+
+type stageResultJSON struct {
+	Status   StageStatus `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Duration string      `json:"duration"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r StageResult) MarshalJSON() ([]byte, error) {
+	j := stageResultJSON{
+		Status:   r.Status,
+		Duration: r.Duration.String(),
+	}
+	if r.Err != nil {
+		j.Error = r.Err.Error()
+	}
+	return json.Marshal(j)
+}
+
+// BlockedPlan describes route changes blocked by Options.ChurnLimits.
+type BlockedPlan struct {
+	// ID is what to pass to Daemon.ConfirmPlan to apply the changes anyway.
+	ID       string   `json:"id"`
+	Summary  string   `json:"summary"`
+	Exceeded []string `json:"exceeded"`
+}
+
+// Result describes what happened in a reconcile iteration.
+type Result struct {
+	StartedAt time.Time
+	Duration  time.Duration
+
+	Config StageResult
+	DNS    StageResult
+	Health StageResult
+	Routes StageResult
+
+	ConfigHash     string
+	ConfigSources  []config.SourceInfo
+	DomainIPs      int // number of IPs resolved from domains
+	VPNIPs         int // number of IPs, static and resolved, to route through VPN and group interfaces
+	DampedIPs      int // number of IPs no longer resolved but kept routed by flap damping
+	RoutesAdded    int
+	RoutesReplaced int
+	RoutesDeleted  int
+	// RoutesRolledBack is true if applying routes failed and the changes were
+	// undone.
+	RoutesRolledBack bool
+	// KillSwitch is true if the VPN interface is absent and VPN destinations
+	// are rejected.
+	KillSwitch bool
+	// DefaultGateway is the gateway the default route goes through, or
+	// empty if it goes through the primary link directly or is unmanaged.
+	DefaultGateway string
+
+	// BlockedPlan is set if the routes stage is StageBlocked.
+	BlockedPlan *BlockedPlan
+
+	// HealthAction is the config.FailurePolicy applied because the VPN failed
+	// its health check, or empty if it didn't.
+	HealthAction config.FailurePolicy
+	// GroupHealthActions maps route groups whose interface failed its health
+	// check to the config.FailurePolicy applied.
+	GroupHealthActions map[string]config.FailurePolicy
+
+	// FailedDomains maps domains that failed to resolve to why.
+	FailedDomains map[string]string
+	// RouteMismatches lists destinations the kernel routes through an
+	// unexpected interface after routes were applied.
+	RouteMismatches []string
+	// RouteConflicts describes destinations that overlap between route
+	// groups.
+	RouteConflicts []string
+	// GroupErrors maps route groups whose interface couldn't be found to why.
+	GroupErrors map[string]string
+	// Protections describes VPN servers and DNS servers that were left out of
+	// VPN routes, or pinned to the primary interface, because config entries
+	// cover them.
+	Protections []string
+}
+
+// healthPolicies maps the VPN, as config.DefaultGroup, and each group to the
+// config.FailurePolicy applied to its routes because it failed its health
+// check. Groups whose policy keeps their routes are left out.
+func (r Result) healthPolicies() map[string]config.FailurePolicy {
+	policies := make(map[string]config.FailurePolicy)
+	if len(r.HealthAction) > 0 && r.HealthAction != config.FailureKeep {
+		policies[config.DefaultGroup] = r.HealthAction
+	}
+	for name, action := range r.GroupHealthActions {
+		if action != config.FailureKeep {
+			policies[name] = action
+		}
+	}
+	return policies
+}
+
+// Err returns the error of the first failed stage, or nil if no stage has
+// failed. A stale config or partially resolved domains don't count as a
+// failure, but route mismatches and blocked route changes do.
+func (r Result) Err() error {
+	for _, stage := range r.stages() {
+		switch stage.result.Status {
+		case StageFailed, StageMismatch, StageBlocked:
+			return stage.result.Err
+		}
+	}
+	return nil
+}
+
+// stages returns stage names along with their results, in the order they run.
+func (r Result) stages() []struct {
+	name   string
+	result StageResult
+} {
+	return []struct {
+		name   string
+		result StageResult
+	}{
+		{"config", r.Config},
+		{"dns", r.DNS},
+		{"health", r.Health},
+		{"routes", r.Routes},
+	}
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler.
+func (r Result) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddTime("startedAt", r.StartedAt)
+	enc.AddDuration("duration", r.Duration)
+	for _, stage := range r.stages() {
+		if err := enc.AddObject(stage.name, stage.result); err != nil {
+			return err
+		}
+	}
+	enc.AddString("configHash", r.ConfigHash)
+	enc.AddInt("domainIPs", r.DomainIPs)
+	enc.AddInt("vpnIPs", r.VPNIPs)
+	if r.DampedIPs > 0 {
+		enc.AddInt("dampedIPs", r.DampedIPs)
+	}
+	enc.AddInt("routesAdded", r.RoutesAdded)
+	enc.AddInt("routesReplaced", r.RoutesReplaced)
+	enc.AddInt("routesDeleted", r.RoutesDeleted)
+	if r.RoutesRolledBack {
+		enc.AddBool("routesRolledBack", true)
+	}
+	if r.KillSwitch {
+		enc.AddBool("killSwitch", true)
+	}
+	if len(r.DefaultGateway) > 0 {
+		enc.AddString("defaultGateway", r.DefaultGateway)
+	}
+	if r.BlockedPlan != nil {
+		enc.AddString("blockedPlan", r.BlockedPlan.ID)
+	}
+	if len(r.HealthAction) > 0 {
+		enc.AddString("healthAction", string(r.HealthAction))
+	}
+	if len(r.GroupHealthActions) > 0 {
+		enc.AddInt("groupHealthActions", len(r.GroupHealthActions))
+	}
+	if len(r.FailedDomains) > 0 {
+		enc.AddInt("failedDomains", len(r.FailedDomains))
+	}
+	if len(r.RouteMismatches) > 0 {
+		enc.AddInt("routeMismatches", len(r.RouteMismatches))
+	}
+	if len(r.RouteConflicts) > 0 {
+		enc.AddInt("routeConflicts", len(r.RouteConflicts))
+	}
+	if len(r.GroupErrors) > 0 {
+		enc.AddInt("groupErrors", len(r.GroupErrors))
+	}
+	if len(r.Protections) > 0 {
+		enc.AddInt("protections", len(r.Protections))
+	}
+	return nil
+}
+
+type resultJSON struct {
+	StartedAt          time.Time         `json:"startedAt"`
+	Duration           string            `json:"duration"`
+	Config             StageResult       `json:"config"`
+	DNS                StageResult       `json:"dns"`
+	Health             StageResult       `json:"health"`
+	Routes             StageResult       `json:"routes"`
+	ConfigHash         string            `json:"configHash"`
+	DomainIPs          int               `json:"domainIPs"`
+	VPNIPs             int               `json:"vpnIPs"`
+	DampedIPs          int               `json:"dampedIPs,omitempty"`
+	RoutesAdded        int               `json:"routesAdded"`
+	RoutesReplaced     int               `json:"routesReplaced"`
+	RoutesDeleted      int               `json:"routesDeleted"`
+	RoutesRolledBack   bool              `json:"routesRolledBack,omitempty"`
+	KillSwitch         bool              `json:"killSwitch,omitempty"`
+	DefaultGateway     string            `json:"defaultGateway,omitempty"`
+	BlockedPlan        *BlockedPlan      `json:"blockedPlan,omitempty"`
+	HealthAction       string            `json:"healthAction,omitempty"`
+	GroupHealthActions map[string]string `json:"groupHealthActions,omitempty"`
+	FailedDomains      map[string]string `json:"failedDomains,omitempty"`
+	RouteMismatches    []string          `json:"routeMismatches,omitempty"`
+	RouteConflicts     []string          `json:"routeConflicts,omitempty"`
+	GroupErrors        map[string]string `json:"groupErrors,omitempty"`
+	Protections        []string          `json:"protections,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r Result) MarshalJSON() ([]byte, error) {
+	var groupHealth map[string]string
+	if len(r.GroupHealthActions) > 0 {
+		groupHealth = make(map[string]string, len(r.GroupHealthActions))
+		for name, action := range r.GroupHealthActions {
+			groupHealth[name] = string(action)
+		}
+	}
+	return json.Marshal(resultJSON{
+		StartedAt:          r.StartedAt,
+		Duration:           r.Duration.String(),
+		Config:             r.Config,
+		DNS:                r.DNS,
+		Health:             r.Health,
+		Routes:             r.Routes,
+		ConfigHash:         r.ConfigHash,
+		DomainIPs:          r.DomainIPs,
+		VPNIPs:             r.VPNIPs,
+		DampedIPs:          r.DampedIPs,
+		RoutesAdded:        r.RoutesAdded,
+		RoutesReplaced:     r.RoutesReplaced,
+		RoutesDeleted:      r.RoutesDeleted,
+		RoutesRolledBack:   r.RoutesRolledBack,
+		KillSwitch:         r.KillSwitch,
+		DefaultGateway:     r.DefaultGateway,
+		BlockedPlan:        r.BlockedPlan,
+		HealthAction:       string(r.HealthAction),
+		GroupHealthActions: groupHealth,
+		FailedDomains:      r.FailedDomains,
+		RouteMismatches:    r.RouteMismatches,
+		RouteConflicts:     r.RouteConflicts,
+		GroupErrors:        r.GroupErrors,
+		Protections:        r.Protections,
+	})
+}